@@ -17,17 +17,20 @@
 package babe
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ChainSafe/gossamer/common"
 	tx "github.com/ChainSafe/gossamer/common/transaction"
 	"github.com/ChainSafe/gossamer/runtime"
 	log "github.com/ChainSafe/log15"
+	ed25519 "golang.org/x/crypto/ed25519"
 )
 
 // Session contains the VRF keys for the validator
@@ -46,6 +49,26 @@ type Session struct {
 	epochThreshold *big.Int // validator threshold for this epoch
 	txQueue        *tx.PriorityQueue
 	isProducer     map[uint64]bool // whether we are a block producer at a slot
+	clock          Clock
+	genesisSlot    uint64 // slot of block 1, epochs are counted from it
+
+	epochLock    sync.Mutex
+	currentEpoch uint64         // epoch of the latest slot seen by advanceSlot
+	epochHooks   []func(uint64) // called with the new epoch number when crossing an epoch boundary
+	randomness   common.Hash    // accumulated VRF outputs of the current epoch
+	// accumulated randomness of the epoch before the current one, nil until the first epoch ended
+	epochRandomness []byte
+	// randomness the epoch before the current one used in its VRF input, so its slot claims can still be
+	// validated. nil in the first epoch or after skipping an epoch
+	previousRandomness []byte
+	// authority set of the current epoch, the configuration's genesis authorities while nil
+	authorities []AuthorityData
+	// authority set that becomes the current one at the next epoch boundary, nil if there's no change
+	nextAuthorities []AuthorityData
+
+	equivocationLock sync.Mutex
+	slotAuthors      map[uint64]map[slotAuthor]common.Hash // first header seen per slot and author, by epoch
+	latestEpochSeen  uint64                                // latest epoch in slotAuthors
 }
 
 // NewSession returns a new Babe session using the provided VRF keys and runtime
@@ -56,6 +79,8 @@ func NewSession(pubkey VrfPublicKey, privkey VrfPrivateKey, rt *runtime.Runtime)
 		rt:            rt,
 		txQueue:       new(tx.PriorityQueue),
 		isProducer:    make(map[uint64]bool),
+		clock:         realClock{},
+		slotAuthors:   make(map[uint64]map[slotAuthor]common.Hash),
 	}
 }
 
@@ -74,6 +99,8 @@ func (b *Session) Start() error {
 		var currentSlot uint64 = 0
 
 		for ; currentSlot < b.config.EpochLength; currentSlot++ {
+			b.advanceSlot(currentSlot)
+
 			if b.isProducer[currentSlot] {
 				// TODO: build block
 				log.Info("BABE: building block", "slot", currentSlot)
@@ -86,6 +113,253 @@ func (b *Session) Start() error {
 	return nil
 }
 
+// Validate checks the session's configuration, so that a misconfigured session fails at startup rather
+// than when a slot is processed. Every invalid field is listed in the returned error.
+func (b *Session) Validate() error {
+	if b.config == nil {
+		return errors.New("invalid babe config: no config")
+	}
+
+	var invalid []string
+	if b.config.SlotDuration == 0 {
+		invalid = append(invalid, "slot duration is 0")
+	}
+	if b.config.EpochLength == 0 {
+		invalid = append(invalid, "epoch length is 0")
+	}
+	if len(b.config.GenesisAuthorities) == 0 {
+		invalid = append(invalid, "no authorities")
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid babe config: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// SetClock replaces the wall clock used by the session, e.g. with a MockClock in tests
+func (b *Session) SetClock(clock Clock) {
+	b.clock = clock
+}
+
+// SetGenesisSlot sets the slot of block 1, which the session's epochs are counted from. It defaults to 0.
+func (b *Session) SetGenesisSlot(slot uint64) {
+	b.genesisSlot = slot
+}
+
+// SetGenesisArrivalTime sets the genesis slot to the slot containing the arrival time of block 1, in
+// milliseconds since the Unix epoch
+func (b *Session) SetGenesisArrivalTime(arrivalTime uint64) error {
+	slot, err := b.TimestampToSlot(arrivalTime)
+	if err != nil {
+		return fmt.Errorf("cannot derive genesis slot: %w", err)
+	}
+	b.genesisSlot = slot
+	return nil
+}
+
+// GenesisSlot returns the slot of block 1, see SetGenesisSlot
+func (b *Session) GenesisSlot() uint64 {
+	return b.genesisSlot
+}
+
+// CurrentSlot returns the slot at the current time of the session's clock. Slots are counted
+// in SlotDuration intervals from the Unix epoch.
+func (b *Session) CurrentSlot() (uint64, error) {
+	if b.config == nil || b.config.SlotDuration == 0 {
+		return 0, errors.New("cannot get current slot: no slot duration")
+	}
+	return b.clock.Now() / b.config.SlotDuration, nil
+}
+
+// NextSlotTime returns the first slot starting after the time now, in milliseconds since the Unix epoch,
+// and the time it starts at, so an authoring loop can sleep until then. If now is exactly the start of a
+// slot, that slot has already begun and the one after it is returned.
+func (b *Session) NextSlotTime(now uint64) (slot uint64, fireAt uint64, err error) {
+	if b.config == nil || b.config.SlotDuration == 0 {
+		return 0, 0, errors.New("cannot get next slot time: no slot duration")
+	}
+	slot = now/b.config.SlotDuration + 1
+	return slot, slot * b.config.SlotDuration, nil
+}
+
+// SlotToTimestamp returns the time the slot starts at, in milliseconds since the Unix epoch
+func (b *Session) SlotToTimestamp(slot uint64) (uint64, error) {
+	if b.config == nil || b.config.SlotDuration == 0 {
+		return 0, errors.New("cannot get slot timestamp: no slot duration")
+	}
+	return slot * b.config.SlotDuration, nil
+}
+
+// TimestampToSlot returns the slot containing the time ts, in milliseconds since the Unix epoch. It's the
+// inverse of SlotToTimestamp for the start of a slot, any later time in the slot gives the same slot.
+func (b *Session) TimestampToSlot(ts uint64) (uint64, error) {
+	if b.config == nil || b.config.SlotDuration == 0 {
+		return 0, errors.New("cannot get slot of timestamp: no slot duration")
+	}
+	return ts / b.config.SlotDuration, nil
+}
+
+// EpochForSlot returns the epoch that the slot belongs to, based on the configured EpochLength and
+// counted from the genesis slot. Slots before the genesis slot belong to the first epoch.
+// An EpochLength of 0, or a session without a config, is treated as a single epoch that never ends.
+func (b *Session) EpochForSlot(slot uint64) uint64 {
+	if b.config == nil || b.config.EpochLength == 0 || slot < b.genesisSlot {
+		return 0
+	}
+	return (slot - b.genesisSlot) / b.config.EpochLength
+}
+
+// IsEpochBoundary returns true if the slot is the first slot of an epoch other than the first one. Without
+// a config there is only one epoch, so it returns false.
+func (b *Session) IsEpochBoundary(slot uint64) bool {
+	if b.config == nil || b.config.EpochLength == 0 || slot <= b.genesisSlot {
+		return false
+	}
+	return (slot-b.genesisSlot)%b.config.EpochLength == 0
+}
+
+// OnEpochChange registers a hook that is called with the new epoch number every time the session
+// moves into a later epoch
+func (b *Session) OnEpochChange(hook func(newEpoch uint64)) {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+	b.epochHooks = append(b.epochHooks, hook)
+}
+
+// advanceSlot updates the current epoch for the slot, calling the epoch change hooks if an epoch boundary was crossed
+func (b *Session) advanceSlot(slot uint64) {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	epoch := b.EpochForSlot(slot)
+	if epoch <= b.currentEpoch {
+		return
+	}
+
+	b.previousRandomness = nil
+	if epoch == b.currentEpoch+1 {
+		b.previousRandomness = b.epochInputRandomness()
+	}
+	b.currentEpoch = epoch
+	b.epochRandomness = append([]byte(nil), b.randomness[:]...)
+	b.randomness = common.Hash{}
+	if b.nextAuthorities != nil {
+		b.rotateAuthorities(b.nextAuthorities)
+		b.nextAuthorities = nil
+	}
+	for _, hook := range b.epochHooks {
+		hook(epoch)
+	}
+}
+
+// AccumulateRandomness folds a block's VRF output into the randomness of the current epoch, the
+// accumulator becomes Blake2bHash(accumulator || vrfOutput) and starts from zero in every epoch
+func (b *Session) AccumulateRandomness(vrfOutput []byte) error {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	hash, err := common.Blake2bHash(append(b.randomness[:], vrfOutput...))
+	if err != nil {
+		return err
+	}
+	b.randomness = hash
+	return nil
+}
+
+// EpochRandomness returns the randomness accumulated over the last epoch that ended, it is
+// finalized when advanceSlot crosses an epoch boundary. It returns nil while in the first epoch.
+func (b *Session) EpochRandomness() []byte {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	if b.epochRandomness == nil {
+		return nil
+	}
+	return append([]byte(nil), b.epochRandomness...)
+}
+
+// SetNextAuthorities sets the authority set that replaces the current one when advanceSlot crosses the next
+// epoch boundary, e.g. as announced by the runtime. Until then the current set stays active.
+func (b *Session) SetNextAuthorities(authorities []AuthorityData) {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	b.nextAuthorities = append([]AuthorityData{}, authorities...)
+}
+
+// rotateAuthorities makes authorities the current set, pointing the slot lottery at the session's own entry
+// in it and dropping the cached threshold. Must be called with the epoch lock held.
+func (b *Session) rotateAuthorities(authorities []AuthorityData) {
+	b.authorities = authorities
+	b.authorityWeights = make([]uint64, len(authorities))
+	// an index past the weights marks a session that isn't part of the set
+	b.authorityIndex = uint64(len(authorities))
+	for i, authority := range authorities {
+		b.authorityWeights[i] = authority.AuthorityWeight
+		if authority.AuthorityId == AuthorityID(b.vrfPublicKey) {
+			b.authorityIndex = uint64(i)
+		}
+	}
+	b.epochThreshold = nil
+}
+
+// currentAuthorities returns the authority set of the current epoch
+func (b *Session) currentAuthorities() []AuthorityData {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	if b.authorities != nil {
+		return b.authorities
+	}
+	if b.config == nil {
+		return nil
+	}
+	return b.config.GenesisAuthorities
+}
+
+// AuthorityIndex returns the index of the authority in the authority set of the current epoch, and false
+// if it isn't part of the set
+func (b *Session) AuthorityIndex(id AuthorityID) (uint32, bool) {
+	for i, authority := range b.currentAuthorities() {
+		if authority.AuthorityId == id {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// SecondaryAuthor returns the authority assigned to author the slot if no primary leader exists,
+// selected round-robin over the authority set of the current epoch by slot mod len(authorities).
+// If the authority set is empty, the zero AuthorityID is returned.
+func (b *Session) SecondaryAuthor(slot uint64) AuthorityID {
+	authorities := b.currentAuthorities()
+	if len(authorities) == 0 {
+		return AuthorityID{}
+	}
+	return authorities[slot%uint64(len(authorities))].AuthorityId
+}
+
+// LacksPrimaryClaim returns true if secondary slots are enabled and this validator didn't win the primary
+// lottery of the slot, so it can only author the slot as its SecondaryAuthor. It doesn't tell whether the slot
+// has a primary leader: other authorities' VRF outputs are only known from the claims in their blocks, see
+// ValidateSlotClaim.
+func (b *Session) LacksPrimaryClaim(slot uint64) bool {
+	if b.config == nil || !b.config.SecondarySlots {
+		return false
+	}
+
+	isLeader, ok := b.isProducer[slot]
+	if !ok {
+		var err error
+		isLeader, _, err = b.IsSlotLeader(slot)
+		if err != nil {
+			log.Error("BABE: cannot run slot lottery", "slot", slot, "error", err)
+			return false
+		}
+	}
+	return !isLeader
+}
+
 // PushToTxQueue adds a ValidTransaction to BABE's transaction queue
 func (b *Session) PushToTxQueue(vt *tx.ValidTransaction) {
 	b.txQueue.Insert(vt)
@@ -95,7 +369,7 @@ func (b *Session) PeekFromTxQueue() *tx.ValidTransaction {
 	return b.txQueue.Peek()
 }
 
-// sets the slot lottery threshold for the current epoch
+// sets the slot lottery threshold for the current epoch, must be called with the epoch lock held
 func (b *Session) setEpochThreshold() error {
 	var err error
 	if b.config == nil {
@@ -113,30 +387,84 @@ func (b *Session) setEpochThreshold() error {
 // runs the slot lottery for a specific slot
 // returns true if validator is authorized to produce a block for that slot, false otherwise
 func (b *Session) runLottery(slot uint64) (bool, error) {
-	slotBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(slotBytes, slot)
-	vrfInput := append(slotBytes, b.config.Randomness)
-	output, err := b.vrfSign(vrfInput)
+	isLeader, _, err := b.IsSlotLeader(slot)
+	return isLeader, err
+}
+
+// IsSlotLeader evaluates the VRF over the slot number and the epoch randomness and compares
+// the first 128 bits of the output against the epoch threshold. If the output is below the threshold,
+// the validator is the leader for the slot and the VRF output, including the proof to put in the block,
+// is returned. Otherwise the returned output is nil, as it is if the validator was rotated out of the
+// authority set.
+func (b *Session) IsSlotLeader(slot uint64) (bool, *VrfOutput, error) {
+	if b.config == nil {
+		return false, nil, errors.New("cannot run slot lottery: no babe config")
+	}
+
+	output, err := b.vrfSign(b.vrfInput(slot))
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
-	output_int := new(big.Int).SetBytes(output)
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	if len(b.authorityWeights) > 0 && b.authorityIndex >= uint64(len(b.authorityWeights)) {
+		return false, nil, nil
+	}
 	if b.epochThreshold == nil {
 		err = b.setEpochThreshold()
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 	}
 
-	return output_int.Cmp(b.epochThreshold) > 0, nil
+	// the threshold is scaled to 2^128, so only compare 128 bits of the output
+	outputInt := new(big.Int).SetBytes(output.Output[:16])
+	if outputInt.Cmp(b.epochThreshold) >= 0 {
+		return false, nil, nil
+	}
+
+	return true, output, nil
+}
+
+// vrfInput returns the VRF input for the slot, the slot number followed by the randomness of the slot's epoch.
+// Slots of the epoch before the current one use the randomness that epoch had, any other slot uses the
+// current epoch's. In the first epoch, before any randomness was accumulated, the configuration's randomness
+// is used.
+func (b *Session) vrfInput(slot uint64) []byte {
+	b.epochLock.Lock()
+	defer b.epochLock.Unlock()
+
+	slotBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(slotBytes, slot)
+	if b.previousRandomness != nil && b.EpochForSlot(slot)+1 == b.currentEpoch {
+		return append(slotBytes, b.previousRandomness...)
+	}
+	return append(slotBytes, b.epochInputRandomness()...)
+}
+
+// epochInputRandomness returns the randomness the current epoch uses in its VRF input, must be called with
+// the epoch lock held
+func (b *Session) epochInputRandomness() []byte {
+	if b.epochRandomness == nil {
+		return []byte{b.config.Randomness}
+	}
+	return append([]byte(nil), b.epochRandomness...)
 }
 
-func (b *Session) vrfSign(input []byte) ([]byte, error) {
-	// TOOD: return VRF output and proof
-	out := make([]byte, 32)
-	_, err := rand.Read(out)
-	return out, err
+// TODO: replace with a schnorrkel VRF. Until then, the proof is the ed25519 signature of the input,
+// which is deterministic, and the output is the blake2b hash of the proof.
+func (b *Session) vrfSign(input []byte) (*VrfOutput, error) {
+	out := new(VrfOutput)
+	copy(out.Proof[:], ed25519.Sign(ed25519.PrivateKey(b.vrfPrivateKey[:]), input))
+
+	hash, err := common.Blake2bHash(out.Proof[:])
+	if err != nil {
+		return nil, err
+	}
+	out.Output = hash
+	return out, nil
 }
 
 // calculates the slot lottery threshold for the authority at authorityIndex.
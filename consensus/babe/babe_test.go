@@ -17,17 +17,22 @@
 package babe
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io"
 	"math"
 	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/ChainSafe/gossamer/common"
 	"github.com/ChainSafe/gossamer/runtime"
 	"github.com/ChainSafe/gossamer/trie"
+	ed25519 "golang.org/x/crypto/ed25519"
 )
 
 const POLKADOT_RUNTIME_FP string = "../../substrate_test_runtime.compact.wasm"
@@ -175,6 +180,356 @@ func TestRunLottery(t *testing.T) {
 	}
 }
 
+func newSlotLeaderSession(t *testing.T, C1, C2 uint64, randomness byte) *Session {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+
+	var pubkey VrfPublicKey
+	var privkey VrfPrivateKey
+	copy(pubkey[:], priv.Public().(ed25519.PublicKey))
+	copy(privkey[:], priv)
+
+	babesession := NewSession(pubkey, privkey, nil)
+	babesession.authorityIndex = 0
+	babesession.authorityWeights = []uint64{1}
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+		C1:           C1,
+		C2:           C2,
+		Randomness:   randomness,
+	}
+	return babesession
+}
+
+func TestIsSlotLeader(t *testing.T) {
+	// C = 1/2, so roughly half of the slots are won
+	babesession := newSlotLeaderSession(t, 1, 2, 7)
+
+	expected := []bool{true, true, true, true, false, false, false, false, true, false}
+
+	for slot, win := range expected {
+		isLeader, output, err := babesession.IsSlotLeader(uint64(slot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLeader != win {
+			t.Errorf("Fail: slot %d got %v expected %v", slot, isLeader, win)
+			continue
+		}
+		if !win {
+			if output != nil {
+				t.Errorf("Fail: slot %d expected no output when losing", slot)
+			}
+			continue
+		}
+
+		// the proof signs the slot and randomness, and the output is derived from it
+		input := make([]byte, 8)
+		binary.LittleEndian.PutUint64(input, uint64(slot))
+		input = append(input, babesession.config.Randomness)
+		if !ed25519.Verify(babesession.vrfPublicKey[:], input, output.Proof[:]) {
+			t.Errorf("Fail: slot %d proof does not verify", slot)
+		}
+		hash, err := common.Blake2bHash(output.Proof[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Output != hash {
+			t.Errorf("Fail: slot %d got output %x expected %x", slot, output.Output, hash)
+		}
+	}
+}
+
+func TestIsSlotLeader_Deterministic(t *testing.T) {
+	// C = 1 wins every slot, C = 0 loses every slot
+	winner := newSlotLeaderSession(t, 1, 1, 0)
+	loser := newSlotLeaderSession(t, 0, 1, 0)
+
+	for slot := uint64(0); slot < 10; slot++ {
+		isLeader, first, err := winner.IsSlotLeader(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isLeader {
+			t.Errorf("Fail: expected to win slot %d with C = 1", slot)
+		}
+
+		_, second, err := winner.IsSlotLeader(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *first != *second {
+			t.Errorf("Fail: slot %d output is not deterministic", slot)
+		}
+
+		isLeader, _, err = loser.IsSlotLeader(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLeader {
+			t.Errorf("Fail: expected to lose slot %d with C = 0", slot)
+		}
+	}
+}
+
+func TestEpochForSlot(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+
+	testCases := []struct {
+		slot     uint64
+		epoch    uint64
+		boundary bool
+	}{
+		{slot: 0, epoch: 0, boundary: false},
+		{slot: 5, epoch: 0, boundary: false},
+		{slot: 6, epoch: 1, boundary: true},
+		{slot: 7, epoch: 1, boundary: false},
+		{slot: 11, epoch: 1, boundary: false},
+		{slot: 12, epoch: 2, boundary: true},
+		{slot: 600, epoch: 100, boundary: true},
+	}
+
+	for _, test := range testCases {
+		if epoch := babesession.EpochForSlot(test.slot); epoch != test.epoch {
+			t.Errorf("Fail: slot %d got epoch %d expected %d", test.slot, epoch, test.epoch)
+		}
+		if boundary := babesession.IsEpochBoundary(test.slot); boundary != test.boundary {
+			t.Errorf("Fail: slot %d got boundary %v expected %v", test.slot, boundary, test.boundary)
+		}
+	}
+}
+
+func TestEpochForSlot_NoConfig(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+
+	if epoch := babesession.EpochForSlot(600); epoch != 0 {
+		t.Errorf("Fail: got epoch %d expected 0", epoch)
+	}
+	if babesession.IsEpochBoundary(600) {
+		t.Error("Fail: expected no epoch boundary without a config")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := BabeConfiguration{
+		SlotDuration:       1000,
+		EpochLength:        6,
+		GenesisAuthorities: []AuthorityData{{AuthorityId: AuthorityID{0x01}, AuthorityWeight: 1}},
+	}
+
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	err := babesession.Validate()
+	if err == nil {
+		t.Error("Fail: expected an error without config")
+	}
+
+	babesession.config = &valid
+	err = babesession.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noSlotDuration := valid
+	noSlotDuration.SlotDuration = 0
+	noEpochLength := valid
+	noEpochLength.EpochLength = 0
+	noAuthorities := valid
+	noAuthorities.GenesisAuthorities = nil
+
+	testCases := []struct {
+		config   BabeConfiguration
+		expected string
+	}{
+		{config: noSlotDuration, expected: "invalid babe config: slot duration is 0"},
+		{config: noEpochLength, expected: "invalid babe config: epoch length is 0"},
+		{config: noAuthorities, expected: "invalid babe config: no authorities"},
+		{config: BabeConfiguration{}, expected: "invalid babe config: slot duration is 0, epoch length is 0, no authorities"},
+	}
+	for _, test := range testCases {
+		config := test.config
+		babesession.config = &config
+		err = babesession.Validate()
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("Fail: got %v expected %s", err, test.expected)
+		}
+	}
+}
+
+func TestOnEpochChange(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+
+	var epochs []uint64
+	babesession.OnEpochChange(func(newEpoch uint64) {
+		epochs = append(epochs, newEpoch)
+	})
+
+	// each slot is seen twice, the hook must only fire once per crossing
+	for slot := uint64(0); slot < 14; slot++ {
+		babesession.advanceSlot(slot)
+		babesession.advanceSlot(slot)
+	}
+
+	// skipping over an epoch only moves to the latest one
+	babesession.advanceSlot(30)
+
+	expected := []uint64{1, 2, 5}
+	if !reflect.DeepEqual(epochs, expected) {
+		t.Errorf("Fail: got %v expected %v", epochs, expected)
+	}
+}
+
+func TestAccumulateRandomness(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+
+	outputs := [][]byte{{0x01, 0x02}, {0x03}, {0x04, 0x05, 0x06}}
+
+	// reference computation, starting from an all zero accumulator
+	expected := common.Hash{}
+	for _, out := range outputs {
+		hash, err := common.Blake2bHash(append(expected[:], out...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = hash
+	}
+
+	for slot, out := range outputs {
+		babesession.advanceSlot(uint64(slot))
+		err := babesession.AccumulateRandomness(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if res := babesession.EpochRandomness(); res != nil {
+		t.Errorf("Fail: got %x expected no randomness in the first epoch", res)
+	}
+
+	// crossing the boundary finalizes the accumulator, seeing the slot again doesn't reset it twice
+	babesession.advanceSlot(6)
+	babesession.advanceSlot(6)
+	if res := babesession.EpochRandomness(); !bytes.Equal(res, expected[:]) {
+		t.Errorf("Fail: got %x expected %x", res, expected)
+	}
+	if babesession.randomness != (common.Hash{}) {
+		t.Errorf("Fail: got %x expected the accumulator to be reset", babesession.randomness)
+	}
+
+	// an epoch without any outputs finalizes the zero accumulator
+	babesession.advanceSlot(12)
+	if res := babesession.EpochRandomness(); !bytes.Equal(res, make([]byte, 32)) {
+		t.Errorf("Fail: got %x expected zero randomness", res)
+	}
+}
+
+func TestSecondaryAuthor(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+		GenesisAuthorities: []AuthorityData{
+			{AuthorityId: AuthorityID{0x01}, AuthorityWeight: 1},
+			{AuthorityId: AuthorityID{0x02}, AuthorityWeight: 1},
+			{AuthorityId: AuthorityID{0x03}, AuthorityWeight: 1},
+		},
+	}
+
+	expected := []AuthorityID{{0x01}, {0x02}, {0x03}, {0x01}, {0x02}, {0x03}, {0x01}}
+
+	for slot, author := range expected {
+		res := babesession.SecondaryAuthor(uint64(slot))
+		if res != author {
+			t.Errorf("Fail: slot %d got %x expected %x", slot, res, author)
+		}
+		// stable for the same slot and authority set
+		if again := babesession.SecondaryAuthor(uint64(slot)); again != res {
+			t.Errorf("Fail: slot %d got %x then %x", slot, res, again)
+		}
+	}
+
+	babesession.config.GenesisAuthorities = []AuthorityData{}
+	if res := babesession.SecondaryAuthor(1); res != (AuthorityID{}) {
+		t.Errorf("Fail: got %x expected zero authority for an empty set", res)
+	}
+}
+
+func TestAuthorityIndex(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+		GenesisAuthorities: []AuthorityData{
+			{AuthorityId: AuthorityID{0x01}, AuthorityWeight: 1},
+			{AuthorityId: AuthorityID{0x02}, AuthorityWeight: 1},
+		},
+	}
+
+	if idx, ok := babesession.AuthorityIndex(AuthorityID{0x02}); !ok || idx != 1 {
+		t.Errorf("Fail: got %d %v expected 1 true", idx, ok)
+	}
+	if _, ok := babesession.AuthorityIndex(AuthorityID{0x03}); ok {
+		t.Error("Fail: found an authority outside of the set")
+	}
+
+	// the next set only becomes active at the epoch boundary
+	babesession.SetNextAuthorities([]AuthorityData{
+		{AuthorityId: AuthorityID{0x03}, AuthorityWeight: 1},
+		{AuthorityId: AuthorityID{0x02}, AuthorityWeight: 1},
+	})
+	babesession.advanceSlot(5)
+	if _, ok := babesession.AuthorityIndex(AuthorityID{0x03}); ok {
+		t.Error("Fail: next authority set active before the epoch change")
+	}
+
+	babesession.advanceSlot(6)
+	if idx, ok := babesession.AuthorityIndex(AuthorityID{0x03}); !ok || idx != 0 {
+		t.Errorf("Fail: got %d %v expected 0 true", idx, ok)
+	}
+	if idx, ok := babesession.AuthorityIndex(AuthorityID{0x02}); !ok || idx != 1 {
+		t.Errorf("Fail: got %d %v expected 1 true", idx, ok)
+	}
+	if _, ok := babesession.AuthorityIndex(AuthorityID{0x01}); ok {
+		t.Error("Fail: found an authority rotated out of the set")
+	}
+}
+
+func TestLacksPrimaryClaim(t *testing.T) {
+	// C = 0 never wins a primary slot
+	babesession := newSlotLeaderSession(t, 0, 1, 0)
+	babesession.config.SecondarySlots = true
+	if !babesession.LacksPrimaryClaim(1) {
+		t.Errorf("Fail: expected no primary claim without winning the lottery")
+	}
+
+	babesession.config.SecondarySlots = false
+	if babesession.LacksPrimaryClaim(1) {
+		t.Errorf("Fail: expected no secondary claim when secondary slots are disabled")
+	}
+
+	// C = 1 always wins a primary slot
+	babesession = newSlotLeaderSession(t, 1, 1, 0)
+	babesession.config.SecondarySlots = true
+	if babesession.LacksPrimaryClaim(1) {
+		t.Errorf("Fail: expected a primary claim after winning the lottery")
+	}
+}
+
 func TestCalculateThreshold_Failing(t *testing.T) {
 	var C1 uint64 = 5
 	var C2 uint64 = 4
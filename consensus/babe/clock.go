@@ -0,0 +1,66 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time to the Session, so slot scheduling can be driven deterministically in tests
+type Clock interface {
+	Now() uint64 // milliseconds since the Unix epoch
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// MockClock is a Clock whose time only changes when set or advanced
+type MockClock struct {
+	lock sync.Mutex
+	now  uint64
+}
+
+// NewMockClock returns a MockClock starting at time 0
+func NewMockClock() *MockClock {
+	return &MockClock{}
+}
+
+// Now returns the time of the MockClock in milliseconds
+func (c *MockClock) Now() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Set sets the time of the MockClock to now milliseconds
+func (c *MockClock) Set(now uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance moves the time of the MockClock forward by d milliseconds
+func (c *MockClock) Advance(d uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now += d
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCurrentSlot_MockClock(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+	clock := NewMockClock()
+	babesession.SetClock(clock)
+
+	var epochs []uint64
+	babesession.OnEpochChange(func(newEpoch uint64) {
+		epochs = append(epochs, newEpoch)
+	})
+
+	clock.Set(5999)
+	testCases := []struct {
+		advance uint64
+		slot    uint64
+	}{
+		{advance: 0, slot: 5},
+		{advance: 1, slot: 6},
+		{advance: 999, slot: 6},
+		{advance: 1, slot: 7},
+		{advance: 5000, slot: 12},
+	}
+
+	for _, test := range testCases {
+		clock.Advance(test.advance)
+		slot, err := babesession.CurrentSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot != test.slot {
+			t.Errorf("Fail: at %d got slot %d expected %d", clock.Now(), slot, test.slot)
+		}
+		babesession.advanceSlot(slot)
+	}
+
+	expected := []uint64{1, 2}
+	if !reflect.DeepEqual(epochs, expected) {
+		t.Errorf("Fail: got epochs %v expected %v", epochs, expected)
+	}
+}
+
+func TestCurrentSlot_NoSlotDuration(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{}
+
+	_, err := babesession.CurrentSlot()
+	if err == nil {
+		t.Fatal("Fail: expected error for zero slot duration")
+	}
+}
+
+func TestNextSlotTime(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+	}
+
+	testCases := []struct {
+		now    uint64
+		slot   uint64
+		fireAt uint64
+	}{
+		{now: 0, slot: 1, fireAt: 1000},
+		{now: 1, slot: 1, fireAt: 1000},
+		{now: 999, slot: 1, fireAt: 1000},
+		// on a boundary the slot starting now has already begun
+		{now: 1000, slot: 2, fireAt: 2000},
+		{now: 1500, slot: 2, fireAt: 2000},
+		{now: 6000, slot: 7, fireAt: 7000},
+	}
+
+	for _, test := range testCases {
+		slot, fireAt, err := babesession.NextSlotTime(test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot != test.slot || fireAt != test.fireAt {
+			t.Errorf("Fail: at %d got slot %d at %d expected %d at %d", test.now, slot, fireAt, test.slot, test.fireAt)
+		}
+	}
+
+	babesession.config = &BabeConfiguration{}
+	_, _, err := babesession.NextSlotTime(0)
+	if err == nil {
+		t.Fatal("Fail: expected error for zero slot duration")
+	}
+}
+
+func TestSlotToTimestamp(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+	}
+
+	// the start of a slot converts back to the same slot
+	for _, slot := range []uint64{0, 1, 7, 1570000000} {
+		ts, err := babesession.SlotToTimestamp(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != slot*1000 {
+			t.Errorf("Fail: slot %d got timestamp %d expected %d", slot, ts, slot*1000)
+		}
+		back, err := babesession.TimestampToSlot(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back != slot {
+			t.Errorf("Fail: timestamp %d got slot %d expected %d", ts, back, slot)
+		}
+	}
+
+	// any time within a slot is floored to it
+	testCases := []struct {
+		ts   uint64
+		slot uint64
+	}{
+		{ts: 1, slot: 0},
+		{ts: 999, slot: 0},
+		{ts: 7500, slot: 7},
+		{ts: 7999, slot: 7},
+	}
+	for _, test := range testCases {
+		slot, err := babesession.TimestampToSlot(test.ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot != test.slot {
+			t.Errorf("Fail: timestamp %d got slot %d expected %d", test.ts, slot, test.slot)
+		}
+	}
+
+	babesession.config = &BabeConfiguration{}
+	_, err := babesession.SlotToTimestamp(1)
+	if err == nil {
+		t.Fatal("Fail: expected error for zero slot duration")
+	}
+	_, err = babesession.TimestampToSlot(1)
+	if err == nil {
+		t.Fatal("Fail: expected error for zero slot duration")
+	}
+}
+
+func TestGenesisSlot(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	err := babesession.SetGenesisArrivalTime(1234)
+	if err == nil {
+		t.Error("Fail: expected an error without slot duration")
+	}
+
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+	if babesession.GenesisSlot() != 0 {
+		t.Errorf("Fail: got genesis slot %d expected 0", babesession.GenesisSlot())
+	}
+
+	// block 1 arrived 400ms into slot 1579000000
+	arrivalTime := uint64(1579000000400)
+	err = babesession.SetGenesisArrivalTime(arrivalTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisSlot := uint64(1579000000)
+	if babesession.GenesisSlot() != genesisSlot {
+		t.Errorf("Fail: got genesis slot %d expected %d", babesession.GenesisSlot(), genesisSlot)
+	}
+
+	// the genesis slot starts before block 1 arrived and is the slot of its arrival time
+	start, err := babesession.SlotToTimestamp(genesisSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != arrivalTime-400 {
+		t.Errorf("Fail: got genesis slot start %d expected %d", start, arrivalTime-400)
+	}
+	slot, err := babesession.TimestampToSlot(arrivalTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot != genesisSlot {
+		t.Errorf("Fail: got slot %d expected %d", slot, genesisSlot)
+	}
+
+	// epochs are counted from the genesis slot
+	testCases := []struct {
+		slot     uint64
+		epoch    uint64
+		boundary bool
+	}{
+		{slot: 0, epoch: 0, boundary: false},
+		{slot: genesisSlot, epoch: 0, boundary: false},
+		{slot: genesisSlot + 5, epoch: 0, boundary: false},
+		{slot: genesisSlot + 6, epoch: 1, boundary: true},
+		{slot: genesisSlot + 13, epoch: 2, boundary: false},
+	}
+	for _, test := range testCases {
+		if epoch := babesession.EpochForSlot(test.slot); epoch != test.epoch {
+			t.Errorf("Fail: slot %d got epoch %d expected %d", test.slot, epoch, test.epoch)
+		}
+		if boundary := babesession.IsEpochBoundary(test.slot); boundary != test.boundary {
+			t.Errorf("Fail: slot %d got boundary %v expected %v", test.slot, boundary, test.boundary)
+		}
+	}
+
+	// the slot after the first epoch's last one starts an epoch
+	next, fireAt, err := babesession.NextSlotTime(arrivalTime + 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != genesisSlot+6 || fireAt != start+6000 || !babesession.IsEpochBoundary(next) {
+		t.Errorf("Fail: got slot %d at %d expected %d at %d", next, fireAt, genesisSlot+6, start+6000)
+	}
+}
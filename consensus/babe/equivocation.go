@@ -0,0 +1,81 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ChainSafe/gossamer/common"
+)
+
+// slotAuthor identifies the blocks produced by an authority in a slot
+type slotAuthor struct {
+	slot   uint64
+	author AuthorityID
+}
+
+// DetectEquivocation records the header produced by the authority in the slot. If a different header was
+// already recorded for the same slot and authority, a proof containing both headers is returned. Seeing the
+// same header twice is not an equivocation and returns a nil proof.
+// Headers are only kept for the current and previous epoch, slots older than that result in an error, as
+// does a session without a config.
+func (b *Session) DetectEquivocation(slot uint64, authorID AuthorityID, headerHash common.Hash) (*EquivocationProof, error) {
+	if b.config == nil {
+		return nil, errors.New("cannot check equivocation: no babe config")
+	}
+
+	b.equivocationLock.Lock()
+	defer b.equivocationLock.Unlock()
+
+	epoch := b.EpochForSlot(slot)
+	if epoch+1 < b.latestEpochSeen {
+		return nil, fmt.Errorf("cannot check equivocation at slot %d: epoch %d has been pruned", slot, epoch)
+	}
+
+	if epoch > b.latestEpochSeen {
+		b.latestEpochSeen = epoch
+		for e := range b.slotAuthors {
+			if e+1 < epoch {
+				delete(b.slotAuthors, e)
+			}
+		}
+	}
+
+	seen := b.slotAuthors[epoch]
+	if seen == nil {
+		seen = make(map[slotAuthor]common.Hash)
+		b.slotAuthors[epoch] = seen
+	}
+
+	key := slotAuthor{slot: slot, author: authorID}
+	first, ok := seen[key]
+	if !ok {
+		seen[key] = headerHash
+		return nil, nil
+	}
+	if first == headerHash {
+		return nil, nil
+	}
+
+	return &EquivocationProof{
+		Slot:         slot,
+		Author:       authorID,
+		FirstHeader:  first,
+		SecondHeader: headerHash,
+	}, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"testing"
+
+	"github.com/ChainSafe/gossamer/common"
+)
+
+func newEquivocationSession() *Session {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+	babesession.config = &BabeConfiguration{
+		SlotDuration: 1000,
+		EpochLength:  6,
+	}
+	return babesession
+}
+
+func TestDetectEquivocation_None(t *testing.T) {
+	babesession := newEquivocationSession()
+
+	// different slots and different authors in the same slot are fine
+	records := []struct {
+		slot   uint64
+		author AuthorityID
+		header common.Hash
+	}{
+		{slot: 1, author: AuthorityID{0x01}, header: common.Hash{0x01}},
+		{slot: 2, author: AuthorityID{0x01}, header: common.Hash{0x02}},
+		{slot: 2, author: AuthorityID{0x02}, header: common.Hash{0x03}},
+	}
+
+	for _, r := range records {
+		proof, err := babesession.DetectEquivocation(r.slot, r.author, r.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof != nil {
+			t.Errorf("Fail: unexpected equivocation %v", proof)
+		}
+	}
+}
+
+func TestDetectEquivocation(t *testing.T) {
+	babesession := newEquivocationSession()
+
+	proof, err := babesession.DetectEquivocation(3, AuthorityID{0x01}, common.Hash{0xAA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof != nil {
+		t.Fatalf("Fail: unexpected equivocation %v", proof)
+	}
+
+	proof, err = babesession.DetectEquivocation(3, AuthorityID{0x01}, common.Hash{0xBB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := EquivocationProof{
+		Slot:         3,
+		Author:       AuthorityID{0x01},
+		FirstHeader:  common.Hash{0xAA},
+		SecondHeader: common.Hash{0xBB},
+	}
+	if proof == nil || *proof != expected {
+		t.Errorf("Fail: got %v expected %v", proof, expected)
+	}
+}
+
+func TestDetectEquivocation_SameHeader(t *testing.T) {
+	babesession := newEquivocationSession()
+
+	for i := 0; i < 2; i++ {
+		proof, err := babesession.DetectEquivocation(3, AuthorityID{0x01}, common.Hash{0xAA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof != nil {
+			t.Errorf("Fail: same header seen twice is not an equivocation, got %v", proof)
+		}
+	}
+}
+
+func TestDetectEquivocation_Pruning(t *testing.T) {
+	babesession := newEquivocationSession()
+
+	// epochs 0, 1 and 2
+	for _, slot := range []uint64{0, 6, 12} {
+		_, err := babesession.DetectEquivocation(slot, AuthorityID{0x01}, common.Hash{0xAA})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(babesession.slotAuthors) != 2 {
+		t.Errorf("Fail: got %d stored epochs expected 2", len(babesession.slotAuthors))
+	}
+	if _, ok := babesession.slotAuthors[0]; ok {
+		t.Errorf("Fail: expected epoch 0 to be pruned")
+	}
+
+	// the previous epoch is still checked
+	proof, err := babesession.DetectEquivocation(6, AuthorityID{0x01}, common.Hash{0xBB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof == nil {
+		t.Errorf("Fail: expected equivocation in the previous epoch")
+	}
+
+	_, err = babesession.DetectEquivocation(0, AuthorityID{0x01}, common.Hash{0xBB})
+	if err == nil {
+		t.Errorf("Fail: expected error for a pruned epoch")
+	}
+}
+
+func TestDetectEquivocation_NoConfig(t *testing.T) {
+	babesession := NewSession([32]byte{}, [64]byte{}, nil)
+
+	proof, err := babesession.DetectEquivocation(1, AuthorityID{0x01}, common.Hash{0x01})
+	if err == nil {
+		t.Errorf("Fail: expected error without a babe config, got proof %v", proof)
+	}
+}
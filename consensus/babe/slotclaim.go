@@ -0,0 +1,85 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ChainSafe/gossamer/common"
+	ed25519 "golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrBadSlotProof is returned when the VRF proof of a slot claim doesn't verify against the author's key
+	ErrBadSlotProof = errors.New("invalid slot claim VRF proof")
+	// ErrAboveThreshold is returned when the VRF output of a primary slot claim isn't below the author's threshold
+	ErrAboveThreshold = errors.New("slot claim VRF output above threshold")
+	// ErrWrongSecondaryAuthor is returned when a secondary slot is claimed by another authority than SecondaryAuthor
+	ErrWrongSecondaryAuthor = errors.New("slot claimed by wrong secondary author")
+	// ErrUnknownAuthority is returned when a slot is claimed by an authority outside of the authority set
+	ErrUnknownAuthority = errors.New("slot claimed by unknown authority")
+)
+
+// ValidateSlotClaim checks that the author of a block legitimately claimed the slot. The proof must be the author's
+// VRF proof over the slot and the randomness of the slot's epoch, verified against the author ID as public key. Its output must be
+// below the author's threshold, derived from the weights of the current epoch's authority set, unless secondary slots are enabled
+// and the author is the slot's SecondaryAuthor.
+func (b *Session) ValidateSlotClaim(slot uint64, author AuthorityID, vrfProof []byte) error {
+	if b.config == nil {
+		return errors.New("cannot validate slot claim: no babe config")
+	}
+
+	authorities := b.currentAuthorities()
+	authorityIndex := -1
+	weights := make([]uint64, len(authorities))
+	for i, authority := range authorities {
+		if authority.AuthorityId == author {
+			authorityIndex = i
+		}
+		weights[i] = authority.AuthorityWeight
+	}
+	if authorityIndex < 0 {
+		return fmt.Errorf("slot %d author %x: %w", slot, author, ErrUnknownAuthority)
+	}
+
+	if len(vrfProof) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(author[:]), b.vrfInput(slot), vrfProof) {
+		return fmt.Errorf("slot %d author %x: %w", slot, author, ErrBadSlotProof)
+	}
+
+	threshold, err := calculateThreshold(b.config.C1, b.config.C2, uint64(authorityIndex), weights)
+	if err != nil {
+		return err
+	}
+	output, err := common.Blake2bHash(vrfProof)
+	if err != nil {
+		return err
+	}
+	// the threshold is scaled to 2^128, so only compare 128 bits of the output, like IsSlotLeader
+	if new(big.Int).SetBytes(output[:16]).Cmp(threshold) < 0 {
+		return nil
+	}
+
+	if !b.config.SecondarySlots {
+		return fmt.Errorf("slot %d author %x: %w", slot, author, ErrAboveThreshold)
+	}
+	if b.SecondaryAuthor(slot) != author {
+		return fmt.Errorf("slot %d author %x: %w", slot, author, ErrWrongSecondaryAuthor)
+	}
+	return nil
+}
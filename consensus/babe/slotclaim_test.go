@@ -0,0 +1,214 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package babe
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newSlotClaimSession returns a slot leader session whose own key is the first authority of the set
+func newSlotClaimSession(t *testing.T, others ...AuthorityID) (*Session, AuthorityID) {
+	babesession := newSlotLeaderSession(t, 1, 2, 7)
+	author := AuthorityID(babesession.vrfPublicKey)
+	babesession.config.GenesisAuthorities = []AuthorityData{{AuthorityId: author, AuthorityWeight: 1}}
+	for _, other := range others {
+		babesession.config.GenesisAuthorities = append(babesession.config.GenesisAuthorities, AuthorityData{AuthorityId: other, AuthorityWeight: 1})
+	}
+	return babesession, author
+}
+
+func TestValidateSlotClaim(t *testing.T) {
+	babesession, author := newSlotClaimSession(t)
+
+	isLeader, output, err := babesession.IsSlotLeader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLeader {
+		t.Fatal("Fail: expected to lead slot 0")
+	}
+
+	err = babesession.ValidateSlotClaim(0, author, output.Proof[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proof is for slot 0 only
+	err = babesession.ValidateSlotClaim(1, author, output.Proof[:])
+	if !errors.Is(err, ErrBadSlotProof) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBadSlotProof)
+	}
+
+	forged := output.Proof
+	forged[0] ^= 0xff
+	err = babesession.ValidateSlotClaim(0, author, forged[:])
+	if !errors.Is(err, ErrBadSlotProof) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBadSlotProof)
+	}
+	err = babesession.ValidateSlotClaim(0, author, output.Proof[:32])
+	if !errors.Is(err, ErrBadSlotProof) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBadSlotProof)
+	}
+
+	err = babesession.ValidateSlotClaim(0, AuthorityID{0xff}, output.Proof[:])
+	if !errors.Is(err, ErrUnknownAuthority) {
+		t.Errorf("Fail: got %v expected %v", err, ErrUnknownAuthority)
+	}
+}
+
+func TestValidateSlotClaim_AboveThreshold(t *testing.T) {
+	babesession, author := newSlotClaimSession(t)
+
+	// slot 4 isn't won, see TestIsSlotLeader
+	output, err := babesession.vrfSign(babesession.vrfInput(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = babesession.ValidateSlotClaim(4, author, output.Proof[:])
+	if !errors.Is(err, ErrAboveThreshold) {
+		t.Errorf("Fail: got %v expected %v", err, ErrAboveThreshold)
+	}
+}
+
+func TestValidateSlotClaim_Secondary(t *testing.T) {
+	babesession, author := newSlotClaimSession(t, AuthorityID{0x02})
+	babesession.config.SecondarySlots = true
+
+	// neither slot is won, slot 4 is assigned to the session's key and slot 5 to the other authority
+	for slot, expected := range map[uint64]error{4: nil, 5: ErrWrongSecondaryAuthor} {
+		output, err := babesession.vrfSign(babesession.vrfInput(slot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = babesession.ValidateSlotClaim(slot, author, output.Proof[:])
+		if !errors.Is(err, expected) {
+			t.Errorf("Fail: slot %d got %v expected %v", slot, err, expected)
+		}
+	}
+}
+
+func TestValidateSlotClaim_EpochRandomness(t *testing.T) {
+	babesession, author := newSlotClaimSession(t)
+	// C = 1, so every slot is won and only the proof decides
+	babesession.config.C1, babesession.config.C2 = 1, 1
+
+	stale, err := babesession.vrfSign(babesession.vrfInput(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = babesession.AccumulateRandomness([]byte{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	babesession.advanceSlot(6)
+
+	// a proof over the first epoch's randomness doesn't verify after the epoch changed
+	err = babesession.ValidateSlotClaim(6, author, stale.Proof[:])
+	if !errors.Is(err, ErrBadSlotProof) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBadSlotProof)
+	}
+
+	isLeader, output, err := babesession.IsSlotLeader(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLeader {
+		t.Fatal("Fail: expected to lead slot 6")
+	}
+	err = babesession.ValidateSlotClaim(6, author, output.Proof[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input := babesession.vrfInput(6); !bytes.Equal(input[8:], babesession.EpochRandomness()) {
+		t.Errorf("Fail: got VRF input %x expected the epoch randomness %x", input[8:], babesession.EpochRandomness())
+	}
+}
+
+func TestValidateSlotClaim_PreviousEpoch(t *testing.T) {
+	babesession, author := newSlotClaimSession(t)
+	// C = 1, so every slot is won and only the proof decides
+	babesession.config.C1, babesession.config.C2 = 1, 1
+
+	claims := make(map[uint64]*VrfOutput)
+	for _, slot := range []uint64{5, 11} {
+		babesession.advanceSlot(slot)
+		_, output, err := babesession.IsSlotLeader(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims[slot] = output
+		err = babesession.AccumulateRandomness(output.Output[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	babesession.advanceSlot(12)
+
+	// the claim of slot 11 was made with the second epoch's randomness, which is kept for its slots
+	err := babesession.ValidateSlotClaim(11, author, claims[11].Proof[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first epoch is two epochs back, so its claims aren't valid any more
+	err = babesession.ValidateSlotClaim(5, author, claims[5].Proof[:])
+	if !errors.Is(err, ErrBadSlotProof) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBadSlotProof)
+	}
+}
+
+func TestIsSlotLeader_AuthorityRotation(t *testing.T) {
+	babesession, author := newSlotClaimSession(t)
+
+	_, _, err := babesession.IsSlotLeader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a much heavier authority joins, so the session's threshold drops
+	babesession.SetNextAuthorities([]AuthorityData{
+		{AuthorityId: AuthorityID{0x02}, AuthorityWeight: 1000},
+		{AuthorityId: author, AuthorityWeight: 1},
+	})
+	babesession.advanceSlot(6)
+	_, _, err = babesession.IsSlotLeader(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := calculateThreshold(1, 2, 1, []uint64{1000, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if babesession.epochThreshold.Cmp(expected) != 0 {
+		t.Errorf("Fail: got threshold %v expected %v", babesession.epochThreshold, expected)
+	}
+
+	// a session rotated out of the set never leads
+	babesession.SetNextAuthorities([]AuthorityData{{AuthorityId: AuthorityID{0x02}, AuthorityWeight: 1}})
+	babesession.advanceSlot(12)
+	for slot := uint64(12); slot < 18; slot++ {
+		isLeader, output, err := babesession.IsSlotLeader(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLeader || output != nil {
+			t.Errorf("Fail: slot %d got leader %v expected no leader", slot, isLeader)
+		}
+	}
+}
@@ -16,10 +16,20 @@
 
 package babe
 
+import (
+	"github.com/ChainSafe/gossamer/common"
+)
+
 // TODO: change to Schnorrkel keys
 type VrfPublicKey [32]byte
 type VrfPrivateKey [64]byte
 
+// VrfOutput is the result of evaluating the VRF over a slot
+type VrfOutput struct {
+	Output [32]byte // compared against the epoch threshold to decide slot leadership
+	Proof  [64]byte // included in the block so others can verify the output
+}
+
 // BabeConfiguration contains the starting data needed for Babe
 // see: https://github.com/paritytech/substrate/blob/426c26b8bddfcdbaf8d29f45b128e0864b57de1c/core/consensus/babe/primitives/src/lib.rs#L132
 type BabeConfiguration struct {
@@ -32,8 +42,18 @@ type BabeConfiguration struct {
 	SecondarySlots     bool
 }
 
+// TODO: change to Schnorrkel public key
+type AuthorityID [32]byte
+
 type AuthorityData struct {
-	// TODO: change to Schnorrkel public key
-	AuthorityId     [32]byte
+	AuthorityId     AuthorityID
 	AuthorityWeight uint64
 }
+
+// EquivocationProof shows that an authority produced two different blocks in the same slot
+type EquivocationProof struct {
+	Slot         uint64
+	Author       AuthorityID
+	FirstHeader  common.Hash
+	SecondHeader common.Hash
+}
@@ -17,8 +17,13 @@
 package blocktree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/ChainSafe/gossamer/core/types"
 
@@ -31,16 +36,65 @@ import (
 
 type Hash = common.Hash
 
+// AuthorityID identifies the authority that authored a block, a babe.AuthorityID can be passed as is
+type AuthorityID = [32]byte
+
+var (
+	// ErrNodeNotFound is returned when a hash doesn't belong to any node in the BlockTree
+	ErrNodeNotFound = errors.New("cannot find node in block tree")
+	// ErrParentNotFound is returned when adding a block whose parent isn't in the BlockTree
+	ErrParentNotFound = errors.New("cannot find parent block in block tree")
+	// ErrBlockExists is returned when adding a block that is already in the BlockTree
+	ErrBlockExists = errors.New("block already exists in block tree")
+	// ErrNotAncestor is returned when a block is expected to be an ancestor of another one but isn't
+	ErrNotAncestor = errors.New("block is not an ancestor")
+	// ErrNotFinalizedDescendant is returned when finalizing a block that doesn't descend from the finalized block
+	ErrNotFinalizedDescendant = errors.New("block is not a descendant of the finalized block")
+	// ErrInvalidBlockNumber is returned when adding a block whose number doesn't follow its parent's
+	ErrInvalidBlockNumber = errors.New("block number is not one more than its parent's")
+)
+
 // BlockTree represents the current state with all possible blocks
 type BlockTree struct {
 	head            *node
 	leaves          leafMap
 	finalizedBlocks []*node
 	Db              *polkadb.BlockDB
+	reorgHooks      []ReorgHook
+	clock           Clock // arrival time of added blocks
+	tiebreak        Tiebreak
+	nextSeq         uint64 // insertion sequence of the next added block
+
+	subLock        sync.Mutex
+	subscribers    map[uint64]chan Hash
+	nextSubscriber uint64
 }
 
+// BlockInfo is a read-only copy of the data the BlockTree holds for a block
+type BlockInfo struct {
+	Hash        common.Hash
+	ParentHash  common.Hash // zero for the root, which has no parent in the tree
+	Number      *big.Int
+	ArrivalTime uint64
+	Author      AuthorityID   // zero if the block was added without an author
+	Children    []common.Hash // in insertion order
+}
+
+// subscriberBuffer is the number of block hashes buffered for each subscriber
+const subscriberBuffer = 16
+
+// ReorgHook is called when the best chain switches to a different fork
+type ReorgHook func(oldBest, newBest, commonAncestor Hash)
+
 // NewBlockTreeFromGenesis initializes a blocktree with a genesis block.
+// Ties between leaves of equal depth are broken by hash, see TiebreakByHash.
 func NewBlockTreeFromGenesis(genesis types.Block, db *polkadb.BlockDB) *BlockTree {
+	return NewBlockTreeWithTiebreak(genesis, db, TiebreakByHash)
+}
+
+// NewBlockTreeWithTiebreak initializes a blocktree with a genesis block, selecting the deepest leaf
+// among leaves of equal depth by the given tiebreak.
+func NewBlockTreeWithTiebreak(genesis types.Block, db *polkadb.BlockDB, tiebreak Tiebreak) *BlockTree {
 	head := &node{
 		hash:     genesis.Header.Hash,
 		number:   genesis.Header.Number,
@@ -53,13 +107,119 @@ func NewBlockTreeFromGenesis(genesis types.Block, db *polkadb.BlockDB) *BlockTre
 		finalizedBlocks: []*node{},
 		leaves:          leafMap{head.hash: head},
 		Db:              db,
+		clock:           realClock{},
+		tiebreak:        tiebreak,
+		nextSeq:         1,
+	}
+}
+
+// Rebuild creates a BlockTree from blocks given in any order, e.g. as loaded from the database. The one block
+// whose parent isn't in the slice becomes the root, every other block is added after its parent. An error wrapping
+// ErrParentNotFound is returned if more than one block has a parent outside of the slice, and ErrBlockExists if a
+// hash appears twice. The Db of the returned tree is nil.
+func Rebuild(blocks []types.Block) (*BlockTree, error) {
+	if len(blocks) == 0 {
+		return nil, errors.New("cannot rebuild block tree from no blocks")
+	}
+
+	byHash := make(map[Hash]bool, len(blocks))
+	for _, block := range blocks {
+		if byHash[block.Header.Hash] {
+			return nil, fmt.Errorf("cannot rebuild block 0x%x: %w", block.Header.Hash, ErrBlockExists)
+		}
+		byHash[block.Header.Hash] = true
+	}
+
+	var root *types.Block
+	children := make(map[Hash][]types.Block)
+	for i, block := range blocks {
+		// a genesis block can have the zero hash as both its hash and parent hash
+		if byHash[block.Header.ParentHash] && block.Header.ParentHash != block.Header.Hash {
+			children[block.Header.ParentHash] = append(children[block.Header.ParentHash], block)
+			continue
+		}
+		if root != nil {
+			return nil, fmt.Errorf("cannot rebuild block 0x%x with parent 0x%x: %w", block.Header.Hash, block.Header.ParentHash, ErrParentNotFound)
+		}
+		root = &blocks[i]
+	}
+	if root == nil {
+		return nil, fmt.Errorf("cannot rebuild block tree without a root: %w", ErrParentNotFound)
+	}
+
+	// add breadth first from the root, so every parent is in the tree before its children
+	bt := NewBlockTreeFromGenesis(*root, nil)
+	queue := []Hash{root.Header.Hash}
+	added := 1
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, block := range children[parent] {
+			err := bt.AddBlock(block)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, block.Header.Hash)
+			added++
+		}
+	}
+	// the remaining blocks have parents, but form a cycle that never reaches the root
+	if added != len(blocks) {
+		return nil, fmt.Errorf("cannot rebuild %d blocks not descending from root 0x%x: %w", len(blocks)-added, root.Header.Hash, ErrParentNotFound)
+	}
+
+	return bt, nil
+}
+
+// Clone returns a deep copy of the BlockTree, e.g. to insert speculative blocks without affecting the original.
+// Every node is copied, so changes to either tree, including arrival times, don't show in the other. The copy
+// shares the Db, clock and tiebreak of the original, but starts without reorg hooks or subscribers.
+func (bt *BlockTree) Clone() *BlockTree {
+	copies := make(map[*node]*node)
+	c := &BlockTree{
+		head:            bt.head.clone(nil, copies),
+		leaves:          make(leafMap, len(bt.leaves)),
+		finalizedBlocks: make([]*node, len(bt.finalizedBlocks)),
+		Db:              bt.Db,
+		clock:           bt.clock,
+		tiebreak:        bt.tiebreak,
+		nextSeq:         bt.nextSeq,
 	}
+	for hash, leaf := range bt.leaves {
+		c.leaves[hash] = copies[leaf]
+	}
+	// the finalized blocks above the root are detached, only the latest may still be the root
+	for i, f := range bt.finalizedBlocks {
+		if copied, ok := copies[f]; ok {
+			c.finalizedBlocks[i] = copied
+		} else {
+			c.finalizedBlocks[i] = f.clone(nil, copies)
+		}
+	}
+	return c
 }
 
-// AddBlock inserts the block as child of its parent node
+// AddBlock inserts the block as child of its parent node. It returns ErrBlockExists, leaving the tree
+// untouched, if the block was already added and ErrParentNotFound if its parent isn't in the tree.
+// ErrInvalidBlockNumber is returned if the block's number isn't one more than its parent's, unless
+// either number is nil. The block's arrival time is taken from the BlockTree's clock.
 // Note: Assumes block has no children
-func (bt *BlockTree) AddBlock(block types.Block) {
-	parent := bt.GetNode(block.Header.ParentHash)
+func (bt *BlockTree) AddBlock(block types.Block) error {
+	return bt.AddBlockWithArrivalTime(block, bt.clock.Now())
+}
+
+// AddBlockWithArrivalTime inserts the block like AddBlock, with an explicit arrival time in milliseconds since
+// the Unix epoch instead of the clock's, e.g. for blocks replayed from disk
+func (bt *BlockTree) AddBlockWithArrivalTime(block types.Block, arrivalTime uint64) error {
+	return bt.addBlock(block, arrivalTime, AuthorityID{})
+}
+
+// AddBlockWithAuthor inserts the block like AddBlock, recording the authority that authored it for FindByAuthor
+func (bt *BlockTree) AddBlockWithAuthor(block types.Block, author AuthorityID) error {
+	return bt.addBlock(block, bt.clock.Now(), author)
+}
+
+func (bt *BlockTree) addBlock(block types.Block, arrivalTime uint64, author AuthorityID) error {
 	// Check if it already exists
 	// TODO: Can shortcut this by checking DB
 	// TODO: Write blockData to db
@@ -68,22 +228,137 @@ func (bt *BlockTree) AddBlock(block types.Block) {
 	n := bt.GetNode(block.Header.Hash)
 	if n != nil {
 		log.Debug("Attempted to add block to tree that already exists", "hash", n.hash)
-		return
+		return fmt.Errorf("cannot add block 0x%x: %w", block.Header.Hash, ErrBlockExists)
+	}
+
+	parent := bt.GetNode(block.Header.ParentHash)
+	if parent == nil {
+		return fmt.Errorf("cannot add block 0x%x with parent 0x%x: %w", block.Header.Hash, block.Header.ParentHash, ErrParentNotFound)
+	}
+	// a missing number can't be checked
+	if block.Header.Number != nil && parent.number != nil {
+		expected := new(big.Int).Add(parent.number, big.NewInt(1))
+		if block.Header.Number.Cmp(expected) != 0 {
+			return fmt.Errorf("cannot add block 0x%x with number %s after parent number %s: %w", block.Header.Hash, block.Header.Number, parent.number, ErrInvalidBlockNumber)
+		}
 	}
 
 	depth := big.NewInt(0)
 	depth.Add(parent.depth, big.NewInt(1))
 
 	n = &node{
-		hash:     block.Header.Hash,
-		number:   block.Header.Number,
-		parent:   parent,
-		children: []*node{},
-		depth:    depth,
+		hash:        block.Header.Hash,
+		number:      block.Header.Number,
+		parent:      parent,
+		children:    []*node{},
+		depth:       depth,
+		arrivalTime: arrivalTime,
+		author:      author,
+		seq:         bt.nextSeq,
 	}
+	bt.nextSeq++
+	oldBest := bt.DeepestLeaf()
+
 	parent.addChild(n)
 
 	bt.leaves.Replace(parent, n)
+
+	newBest := bt.DeepestLeaf()
+	if !newBest.isDescendantOf(oldBest) {
+		ancestor := newBest.commonAncestor(oldBest)
+		for _, hook := range bt.reorgHooks {
+			hook(oldBest.hash, newBest.hash, ancestor.hash)
+		}
+	}
+
+	bt.notifySubscribers(n.hash)
+
+	return nil
+}
+
+// RemoveBlock removes the block with hash h and all of its descendants from the BlockTree, e.g. once the block
+// is found to be invalid. If the block was on the best chain, the chain gets shorter or switches to another
+// fork, without calling the reorg hooks. The parent becomes a leaf if h was its only child. The root can't be
+// removed, and a hash that isn't in the tree returns ErrNodeNotFound.
+func (bt *BlockTree) RemoveBlock(h Hash) error {
+	n := bt.GetNode(h)
+	if n == nil {
+		return fmt.Errorf("cannot remove 0x%x: %w", h, ErrNodeNotFound)
+	}
+	if n.parent == nil {
+		return fmt.Errorf("cannot remove root 0x%x", h)
+	}
+
+	for hash, leaf := range bt.leaves {
+		if leaf.isDescendantOf(n) {
+			delete(bt.leaves, hash)
+		}
+	}
+
+	parent := n.parent
+	for i, child := range parent.children {
+		if child == n {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	n.parent = nil
+	if len(parent.children) == 0 {
+		bt.leaves[parent.hash] = parent
+	}
+	return nil
+}
+
+// SetClock replaces the wall clock that AddBlock takes arrival times from, e.g. with a mock clock in tests
+func (bt *BlockTree) SetClock(clock Clock) {
+	bt.clock = clock
+}
+
+// Subscribe returns a channel that receives the hash of every block added to the BlockTree, and a function
+// that unsubscribes and closes the channel. The channel is buffered; if a subscriber falls behind, hashes
+// are dropped with a warning rather than blocking AddBlock.
+func (bt *BlockTree) Subscribe() (<-chan Hash, func()) {
+	bt.subLock.Lock()
+	defer bt.subLock.Unlock()
+
+	if bt.subscribers == nil {
+		bt.subscribers = make(map[uint64]chan Hash)
+	}
+	id := bt.nextSubscriber
+	bt.nextSubscriber++
+	ch := make(chan Hash, subscriberBuffer)
+	bt.subscribers[id] = ch
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			bt.subLock.Lock()
+			defer bt.subLock.Unlock()
+			delete(bt.subscribers, id)
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// notifySubscribers sends h to every subscriber without blocking
+func (bt *BlockTree) notifySubscribers(h Hash) {
+	bt.subLock.Lock()
+	defer bt.subLock.Unlock()
+
+	for id, ch := range bt.subscribers {
+		select {
+		case ch <- h:
+		default:
+			log.Warn("BlockTree subscriber is full, dropping block", "subscriber", id, "hash", h)
+		}
+	}
+}
+
+// OnReorg registers a hook that is called when adding a block makes the deepest leaf a block that isn't on the
+// previous best chain. This includes a fork of equal depth winning the tiebreak of DeepestLeaf.
+func (bt *BlockTree) OnReorg(hook ReorgHook) {
+	bt.reorgHooks = append(bt.reorgHooks, hook)
 }
 
 // GetNode finds and returns a node based on its hash. Returns nil if not found.
@@ -101,8 +376,307 @@ func (bt *BlockTree) GetNode(h Hash) *node {
 	return nil
 }
 
-// String utilizes github.com/disiqueira/gotree to create a printable tree
+// GetLeaves returns the hashes of all the chain tips, sorted by depth (the block number relative to the root's)
+// and then by hash
+func (bt *BlockTree) GetLeaves() []common.Hash {
+	leaves := make([]*node, 0, len(bt.leaves))
+	for _, n := range bt.leaves {
+		leaves = append(leaves, n)
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		if cmp := leaves[i].depth.Cmp(leaves[j].depth); cmp != 0 {
+			return cmp < 0
+		}
+		return bytes.Compare(leaves[i].hash[:], leaves[j].hash[:]) < 0
+	})
+
+	hashes := make([]common.Hash, len(leaves))
+	for i, n := range leaves {
+		hashes[i] = n.hash
+	}
+	return hashes
+}
+
+// NodeCount returns the number of blocks in the BlockTree. It traverses the tree, so it's O(n) in the number of blocks.
+func (bt *BlockTree) NodeCount() int {
+	return bt.head.count()
+}
+
+// LeafCount returns the number of chain tips in the BlockTree. Leaves are tracked as blocks are added, so it's O(1).
+func (bt *BlockTree) LeafCount() int {
+	return len(bt.leaves)
+}
+
+// Depth returns the distance from the root to the deepest leaf. It searches the leaves, so it's O(n) in the number of leaves.
+func (bt *BlockTree) Depth() uint64 {
+	return new(big.Int).Sub(bt.DeepestLeaf().depth, bt.head.depth).Uint64()
+}
+
+// GetBlockDepth returns the number of edges from the block with hash h up to the current root, which
+// differs from the block number once the tree has been re-rooted by Finalize or Prune
+func (bt *BlockTree) GetBlockDepth(h Hash) (uint64, error) {
+	n := bt.GetNode(h)
+	if n == nil {
+		return 0, fmt.Errorf("cannot get depth of 0x%x: %w", h, ErrNodeNotFound)
+	}
+	return new(big.Int).Sub(n.depth, bt.head.depth).Uint64(), nil
+}
+
+// GetBlockInfo returns a copy of the data of the block with hash h, changing it doesn't affect the BlockTree
+func (bt *BlockTree) GetBlockInfo(h Hash) (BlockInfo, error) {
+	n := bt.GetNode(h)
+	if n == nil {
+		return BlockInfo{}, fmt.Errorf("cannot get block info of 0x%x: %w", h, ErrNodeNotFound)
+	}
+	return n.info(), nil
+}
+
+// WalkAncestors calls visit with the info of the block with hash h and then of each of its ancestors in turn,
+// up to the root. The walk stops early once visit returns false. The infos are copies like GetBlockInfo's,
+// but only the one being visited is built, so no slice of the whole ancestry is kept.
+func (bt *BlockTree) WalkAncestors(h Hash, visit func(*BlockInfo) bool) error {
+	n := bt.GetNode(h)
+	if n == nil {
+		return fmt.Errorf("cannot walk ancestors of 0x%x: %w", h, ErrNodeNotFound)
+	}
+	for ; n != nil; n = n.parent {
+		info := n.info()
+		if !visit(&info) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ExportChain returns the infos of the blocks from the root to tip, root first, e.g. to serve the headers of a
+// chain. Like GetBlockInfo's, the infos are copies that don't affect the BlockTree.
+func (bt *BlockTree) ExportChain(tip Hash) ([]BlockInfo, error) {
+	n := bt.GetNode(tip)
+	if n == nil {
+		return nil, fmt.Errorf("cannot export chain to 0x%x: %w", tip, ErrNodeNotFound)
+	}
+
+	chain := make([]BlockInfo, new(big.Int).Sub(n.depth, bt.head.depth).Uint64()+1)
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i] = n.info()
+		n = n.parent
+	}
+	return chain, nil
+}
+
+// GetArrivalTime returns the arrival time of the block with hash h
+func (bt *BlockTree) GetArrivalTime(h Hash) (uint64, error) {
+	n := bt.GetNode(h)
+	if n == nil {
+		return 0, fmt.Errorf("cannot get arrival time of 0x%x: %w", h, ErrNodeNotFound)
+	}
+	return n.arrivalTime, nil
+}
+
+// SetArrivalTime replaces the arrival time of the block with hash h, eg. when a more accurate timestamp is known
+func (bt *BlockTree) SetArrivalTime(h Hash, t uint64) error {
+	n := bt.GetNode(h)
+	if n == nil {
+		return fmt.Errorf("cannot set arrival time of 0x%x: %w", h, ErrNodeNotFound)
+	}
+	n.arrivalTime = t
+	return nil
+}
+
+// ApplyArrivalTimes sets the arrival times of the blocks in times at once, e.g. when they're received after
+// the tree was rebuilt from headers. Blocks that are in the BlockTree are updated even if others aren't,
+// the hashes that weren't found are listed in the returned error, which wraps ErrNodeNotFound.
+func (bt *BlockTree) ApplyArrivalTimes(times map[Hash]uint64) error {
+	var missing []Hash
+	for h, t := range times {
+		n := bt.GetNode(h)
+		if n == nil {
+			missing = append(missing, h)
+			continue
+		}
+		n.arrivalTime = t
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return bytes.Compare(missing[i][:], missing[j][:]) < 0
+	})
+	hashes := make([]string, len(missing))
+	for i, h := range missing {
+		hashes[i] = fmt.Sprintf("0x%x", h)
+	}
+	return fmt.Errorf("cannot set arrival times of %s: %w", strings.Join(hashes, ", "), ErrNodeNotFound)
+}
+
+// IsDescendantOf returns true if the block with hash descendant is a descendant of the block with hash
+// ancestor, following parent links from descendant up to the root. A block is considered a descendant
+// of itself. An error is returned if either hash is not in the BlockTree.
+func (bt *BlockTree) IsDescendantOf(ancestor, descendant Hash) (bool, error) {
+	an := bt.GetNode(ancestor)
+	if an == nil {
+		return false, fmt.Errorf("ancestor 0x%x: %w", ancestor, ErrNodeNotFound)
+	}
+	dn := bt.GetNode(descendant)
+	if dn == nil {
+		return false, fmt.Errorf("descendant 0x%x: %w", descendant, ErrNodeNotFound)
+	}
+	return dn.isDescendantOf(an), nil
+}
+
+// HighestCommonAncestor returns the hash of the deepest block that both a and b descend from. If one of the blocks
+// is an ancestor of the other, that block is returned. An error is returned if either hash is not in the BlockTree.
+func (bt *BlockTree) HighestCommonAncestor(a, b Hash) (Hash, error) {
+	an := bt.GetNode(a)
+	if an == nil {
+		return Hash{}, fmt.Errorf("cannot find common ancestor of 0x%x: %w", a, ErrNodeNotFound)
+	}
+	bn := bt.GetNode(b)
+	if bn == nil {
+		return Hash{}, fmt.Errorf("cannot find common ancestor of 0x%x: %w", b, ErrNodeNotFound)
+	}
+
+	ancestor := an.commonAncestor(bn)
+	if ancestor == nil {
+		return Hash{}, fmt.Errorf("0x%x and 0x%x share no ancestor", a, b)
+	}
+	return ancestor.hash, nil
+}
+
+// ChainLength returns the number of edges on the path from descendant up to ancestor, 0 if they're the same block.
+// An error is returned if either hash is not in the BlockTree or if ancestor isn't an ancestor of descendant.
+func (bt *BlockTree) ChainLength(ancestor, descendant Hash) (uint64, error) {
+	isDescendant, err := bt.IsDescendantOf(ancestor, descendant)
+	if err != nil {
+		return 0, err
+	}
+	if !isDescendant {
+		return 0, fmt.Errorf("0x%x of 0x%x: %w", ancestor, descendant, ErrNotAncestor)
+	}
+
+	length := new(big.Int).Sub(bt.GetNode(descendant).depth, bt.GetNode(ancestor).depth)
+	return length.Uint64(), nil
+}
+
+// CanonicalChainContains returns true if the block with hash h is on the path from the deepest leaf up to the root.
+// Blocks that are only on other forks, or not in the tree at all, return false.
+func (bt *BlockTree) CanonicalChainContains(h Hash) bool {
+	for n := bt.DeepestLeaf(); n != nil; n = n.parent {
+		if n.hash == h {
+			return true
+		}
+	}
+	return false
+}
+
+// LowestBranchPoint returns the hash of the block closest to the root that has more than one child, i.e. how far
+// back the forks of the BlockTree reach, and false if the tree is a single chain. Blocks are compared by depth,
+// as a number may be missing, and of the branching blocks at the same depth the one with the lowest hash is
+// returned.
+func (bt *BlockTree) LowestBranchPoint() (Hash, bool) {
+	// breadth first, so the first level with a branch holds the lowest ones
+	level := []*node{bt.head}
+	for len(level) > 0 {
+		var branch *node
+		var next []*node
+		for _, n := range level {
+			if len(n.children) > 1 && (branch == nil || bytes.Compare(n.hash[:], branch.hash[:]) < 0) {
+				branch = n
+			}
+			next = append(next, n.children...)
+		}
+		if branch != nil {
+			return branch.hash, true
+		}
+		level = next
+	}
+	return Hash{}, false
+}
+
+// FindByAuthor returns the hashes of every block in the tree authored by author, across every fork, in ascending
+// block number order. Blocks of the same number are ordered by hash. Blocks added without an author match the
+// zero AuthorityID.
+func (bt *BlockTree) FindByAuthor(author AuthorityID) []common.Hash {
+	// breadth first, so every level holds the blocks of one number
+	found := []common.Hash{}
+	level := []*node{bt.head}
+	for len(level) > 0 {
+		var matches []common.Hash
+		var next []*node
+		for _, n := range level {
+			if n.author == author {
+				matches = append(matches, n.hash)
+			}
+			next = append(next, n.children...)
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			return bytes.Compare(matches[i][:], matches[j][:]) < 0
+		})
+		found = append(found, matches...)
+		level = next
+	}
+	return found
+}
+
+// GetAllBlocksAtDepth returns the hashes of all the blocks in the tree whose block number is depth, across
+// every fork, in the order they were added. Blocks without a number are never returned. A number with no
+// blocks results in an empty, non-nil slice.
+func (bt *BlockTree) GetAllBlocksAtDepth(depth *big.Int) []common.Hash {
+	nodes := bt.head.getNodesWithNumber(depth, nil)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].seq < nodes[j].seq
+	})
+	hashes := make([]common.Hash, len(nodes))
+	for i, n := range nodes {
+		hashes[i] = n.hash
+	}
+	return hashes
+}
+
+// GetNodeFromBlockNumber returns the node with the given block number on the current best chain (see LongestChain),
+// or nil if the best chain has no such block. Blocks with the same number on other forks are never returned.
+func (bt *BlockTree) GetNodeFromBlockNumber(number *big.Int) *node {
+	for _, n := range bt.LongestChain() {
+		if n.number != nil && n.number.Cmp(number) == 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// GetNodeFromBlockNumberOnChain returns the node with the given block number on the chain ending at tip,
+// which doesn't need to be a leaf
+func (bt *BlockTree) GetNodeFromBlockNumberOnChain(number *big.Int, tip Hash) (*node, error) {
+	n := bt.GetNode(tip)
+	if n == nil {
+		return nil, fmt.Errorf("cannot find tip 0x%x: %w", tip, ErrNodeNotFound)
+	}
+
+	for curr := n; curr != nil; curr = curr.parent {
+		if curr.number != nil && curr.number.Cmp(number) == 0 {
+			return curr, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find block number %s on chain ending at 0x%x: %w", number, tip, ErrNodeNotFound)
+}
+
+// String returns a one line summary of the BlockTree for logs, with the root hash prefix, the node and leaf
+// counts and the deepest leaf's hash prefix and number, e.g. blocktree{root:0xab.. nodes:42 leaves:3 best:0xcd..#40}.
+// Counting the nodes walks the tree once, use Tree to print the whole tree.
 func (bt *BlockTree) String() string {
+	best := bt.DeepestLeaf()
+	// fall back to the depth for blocks added without a number
+	number := best.number
+	if number == nil {
+		number = best.depth
+	}
+	return fmt.Sprintf("blocktree{root:0x%x.. nodes:%d leaves:%d best:0x%x..#%s}",
+		bt.head.hash[:1], bt.NodeCount(), bt.LeafCount(), best.hash[:1], number)
+}
+
+// Tree utilizes github.com/disiqueira/gotree to create a printable tree
+func (bt *BlockTree) Tree() string {
 	// Construct tree
 	tree := gotree.New(bt.head.String())
 	for _, child := range bt.head.children {
@@ -121,7 +695,72 @@ func (bt *BlockTree) String() string {
 	return fmt.Sprintf("%s\n%s\n", metadata, tree.Print())
 }
 
-// LongestPath returns the path from the root to leftmost deepest leaf in BlockTree BT
+// ToDOT returns a Graphviz digraph of the BlockTree, with edges from parent to child. Nodes are
+// labeled with a short hash prefix, the block number and the arrival time. The deepest leaf is
+// filled green and, once a block has been finalized, the finalized root is filled blue.
+func (bt *BlockTree) ToDOT() string {
+	deepest := bt.DeepestLeaf()
+	finalized := len(bt.finalizedBlocks) > 0
+
+	sb := &strings.Builder{}
+	sb.WriteString("digraph BlockTree {\n")
+	var write func(n *node)
+	write = func(n *node) {
+		attrs := ""
+		if n == deepest {
+			attrs = `, style=filled, fillcolor="green"`
+		} else if n == bt.head && finalized {
+			attrs = `, style=filled, fillcolor="lightblue"`
+		}
+		fmt.Fprintf(sb, "\t\"0x%x\" [label=\"0x%x\\nnumber: %v\\narrival: %d\"%s];\n",
+			n.hash, n.hash[:4], n.number, n.arrivalTime, attrs)
+		for _, child := range n.children {
+			fmt.Fprintf(sb, "\t\"0x%x\" -> \"0x%x\";\n", n.hash, child.hash)
+			write(child)
+		}
+	}
+	write(bt.head)
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+// RangeByNumber returns the hashes of the blocks on the best chain (see LongestChain) with block numbers in
+// [from, to], in ascending order. It returns an error if from > to or if the range isn't part of the tree,
+// i.e. to is past the deepest leaf or from is below the root.
+func (bt *BlockTree) RangeByNumber(from, to *big.Int) ([]common.Hash, error) {
+	if from.Cmp(to) > 0 {
+		return nil, fmt.Errorf("invalid range: from %s is greater than to %s", from, to)
+	}
+
+	chain := bt.LongestChain()
+	root, tip := chain[0].number, chain[len(chain)-1].number
+	if root == nil || tip == nil {
+		return nil, errors.New("cannot get range: best chain has blocks without number")
+	}
+	if to.Cmp(tip) > 0 {
+		return nil, fmt.Errorf("invalid range: to %s is past the deepest leaf %s", to, tip)
+	}
+	if from.Cmp(root) < 0 {
+		return nil, fmt.Errorf("invalid range: from %s is below the root %s", from, root)
+	}
+
+	hashes := []common.Hash{}
+	for _, n := range chain {
+		if n.number != nil && n.number.Cmp(from) >= 0 && n.number.Cmp(to) <= 0 {
+			hashes = append(hashes, n.hash)
+		}
+	}
+	return hashes, nil
+}
+
+// LongestChain is the fork-choice rule of the BlockTree. It returns the path from the root to
+// the deepest leaf, breaking ties between leaves of equal depth by the BlockTree's tiebreak.
+func (bt *BlockTree) LongestChain() []*node {
+	return bt.LongestPath()
+}
+
+// LongestPath returns the path from the root to the deepest leaf in BlockTree BT (see DeepestLeaf)
 func (bt *BlockTree) LongestPath() []*node {
 	dl := bt.DeepestLeaf()
 	var path []*node
@@ -133,7 +772,109 @@ func (bt *BlockTree) LongestPath() []*node {
 	}
 }
 
-// DeepestLeaf returns leftmost deepest leaf in BlockTree BT
+// DeepestLeaf returns the deepest leaf in BlockTree BT, breaking ties by the BlockTree's tiebreak
 func (bt *BlockTree) DeepestLeaf() *node {
-	return bt.leaves.DeepestLeaf()
+	return bt.leaves.DeepestLeaf(bt.tiebreak)
+}
+
+// Finalize marks the block with hash h as finalized and makes it the new root of the tree,
+// pruning every block that isn't one of its descendants. The blocks on the path from the old
+// root are kept in finalizedBlocks, detached from their pruned forks. Finalizing a block that
+// is already finalized is a no-op.
+func (bt *BlockTree) Finalize(h Hash) error {
+	if bt.head.hash == h {
+		return nil
+	}
+	for _, f := range bt.finalizedBlocks {
+		if f.hash == h {
+			return nil
+		}
+	}
+
+	n := bt.GetNode(h)
+	if n == nil {
+		return fmt.Errorf("cannot finalize 0x%x: %w", h, ErrNodeNotFound)
+	}
+
+	path := bt.setRoot(n)
+
+	// the old root is already recorded if it was finalized before
+	if len(bt.finalizedBlocks) > 0 && bt.finalizedBlocks[len(bt.finalizedBlocks)-1] == path[0] {
+		path = path[1:]
+	}
+
+	bt.finalizedBlocks = append(bt.finalizedBlocks, append(path, n)...)
+
+	return nil
+}
+
+// SetFinalized finalizes the block with hash h like Finalize, pruning every block that isn't one of its
+// descendants. Finalization only moves forward, so finalizing a block that was finalized before the
+// current one returns ErrNotFinalizedDescendant, while finalizing the current one again is a no-op.
+// A block on a pruned fork is no longer in the tree, which returns ErrNodeNotFound.
+func (bt *BlockTree) SetFinalized(h Hash) error {
+	finalized := bt.Finalized()
+	if h == finalized {
+		return nil
+	}
+	for _, f := range bt.finalizedBlocks {
+		if f.hash == h {
+			return fmt.Errorf("cannot finalize 0x%x after 0x%x: %w", h, finalized, ErrNotFinalizedDescendant)
+		}
+	}
+	return bt.Finalize(h)
+}
+
+// Finalized returns the hash of the latest finalized block, or of the root if no block was finalized yet
+func (bt *BlockTree) Finalized() Hash {
+	if len(bt.finalizedBlocks) == 0 {
+		return bt.head.hash
+	}
+	return bt.finalizedBlocks[len(bt.finalizedBlocks)-1].hash
+}
+
+// Prune bounds the size of the BlockTree by re-rooting it at the ancestor of the deepest leaf that is
+// maxDepth blocks above it. Every block that isn't a descendant of the new root is dropped, so the path
+// to the deepest leaf always stays intact. As there is no index besides the leaves, unlinking the pruned
+// blocks is enough for them to be garbage collected. Once a block was finalized it is the root, and Prune
+// never re-roots the tree past it, so Finalized always stays part of the tree.
+func (bt *BlockTree) Prune(maxDepth uint64) {
+	if len(bt.finalizedBlocks) > 0 {
+		return
+	}
+
+	cutoff := new(big.Int).Sub(bt.DeepestLeaf().depth, new(big.Int).SetUint64(maxDepth))
+
+	root := bt.DeepestLeaf()
+	for root.parent != nil && root.depth.Cmp(cutoff) > 0 {
+		root = root.parent
+	}
+	if root == bt.head {
+		return
+	}
+
+	bt.setRoot(root)
+}
+
+// setRoot makes n the root of the BlockTree, dropping the leaves that aren't descendants of n.
+// The nodes on the path from the old root to n are detached from the tree and returned, root first.
+func (bt *BlockTree) setRoot(n *node) []*node {
+	for hash, leaf := range bt.leaves {
+		if !leaf.isDescendantOf(n) {
+			delete(bt.leaves, hash)
+		}
+	}
+
+	var path []*node
+	for curr := n.parent; curr != nil; curr = curr.parent {
+		path = append([]*node{curr}, path...)
+	}
+	for _, p := range path {
+		p.parent = nil
+		p.children = []*node{}
+	}
+
+	n.parent = nil
+	bt.head = n
+	return path
 }
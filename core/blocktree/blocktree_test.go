@@ -17,9 +17,14 @@
 package blocktree
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ChainSafe/gossamer/core/types"
 
@@ -78,7 +83,10 @@ func createFlatTree(t *testing.T, depth int) *BlockTree {
 			Body: types.BlockBody{},
 		}
 
-		bt.AddBlock(block)
+		err = bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
 		previousHash = hash
 	}
 
@@ -102,6 +110,416 @@ func TestBlockTree_GetBlock(t *testing.T) {
 
 }
 
+func TestBlockTree_ChainLength(t *testing.T) {
+	bt := createForkedTree(t)
+
+	testCases := []struct {
+		ancestor   common.Hash
+		descendant common.Hash
+		expected   uint64
+	}{
+		{ancestor: common.Hash{0x02}, descendant: common.Hash{0x02}, expected: 0},
+		{ancestor: common.Hash{0x02}, descendant: common.Hash{0x03}, expected: 1},
+		{ancestor: zeroHash, descendant: common.Hash{0x03}, expected: 3},
+		{ancestor: common.Hash{0x01}, descendant: common.Hash{0xEF}, expected: 2},
+	}
+	for _, test := range testCases {
+		length, err := bt.ChainLength(test.ancestor, test.descendant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length != test.expected {
+			t.Errorf("Fail: 0x%X to 0x%X got %d expected %d", test.ancestor, test.descendant, length, test.expected)
+		}
+	}
+
+	// a sibling fork and the reverse direction aren't ancestors
+	_, err := bt.ChainLength(common.Hash{0x02}, common.Hash{0xEF})
+	if !errors.Is(err, ErrNotAncestor) {
+		t.Errorf("expected %v, got %v", ErrNotAncestor, err)
+	}
+	_, err = bt.ChainLength(common.Hash{0x03}, common.Hash{0x01})
+	if !errors.Is(err, ErrNotAncestor) {
+		t.Errorf("expected %v, got %v", ErrNotAncestor, err)
+	}
+	_, err = bt.ChainLength(common.Hash{0x01}, common.Hash{0x99})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_CanonicalChainContains(t *testing.T) {
+	bt := createForkedTree(t)
+
+	for _, h := range []common.Hash{zeroHash, {0x01}, {0x02}, {0x03}} {
+		if !bt.CanonicalChainContains(h) {
+			t.Errorf("Fail: expected 0x%X on the canonical chain", h)
+		}
+	}
+	for _, h := range []common.Hash{{0xAB}, {0xCD}, {0xEF}, {0x99}} {
+		if bt.CanonicalChainContains(h) {
+			t.Errorf("Fail: expected 0x%X not to be on the canonical chain", h)
+		}
+	}
+}
+
+func TestBlockTree_GetNodeFromBlockNumber(t *testing.T) {
+	bt := createFlatTree(t, 3)
+
+	// fork off block 1 with a shorter chain
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the best chain is resolved by default
+	n := bt.GetNodeFromBlockNumber(big.NewInt(2))
+	if n == nil || n.hash != (common.Hash{0x02}) {
+		t.Errorf("Fail: got %v expected 0x02", n)
+	}
+	if n = bt.GetNodeFromBlockNumber(big.NewInt(4)); n != nil {
+		t.Errorf("Fail: got %v expected no node past the tip", n)
+	}
+
+	testCases := []struct {
+		tip      common.Hash
+		expected common.Hash
+	}{
+		{tip: common.Hash{0x03}, expected: common.Hash{0x02}},
+		{tip: common.Hash{0xAB}, expected: common.Hash{0xAB}},
+	}
+	for _, test := range testCases {
+		n, err := bt.GetNodeFromBlockNumberOnChain(big.NewInt(2), test.tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.hash != test.expected {
+			t.Errorf("Fail: tip 0x%X got 0x%X expected 0x%X", test.tip, n.hash, test.expected)
+		}
+	}
+
+	_, err := bt.GetNodeFromBlockNumberOnChain(big.NewInt(3), common.Hash{0xAB})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+	_, err = bt.GetNodeFromBlockNumberOnChain(big.NewInt(1), common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_String(t *testing.T) {
+	bt := createForkedTree(t)
+
+	expected := "blocktree{root:0x00.. nodes:7 leaves:3 best:0x03..#3}"
+	if bt.String() != expected {
+		t.Errorf("Fail: got %s expected %s", bt, expected)
+	}
+
+	// a best block without a number is shown with its depth
+	err := bt.AddBlock(types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0xEF}, Hash: common.Hash{0xF0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "blocktree{root:0x00.. nodes:8 leaves:3 best:0xf0..#4}"
+	if bt.String() != expected {
+		t.Errorf("Fail: got %s expected %s", bt, expected)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	blocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(0), Hash: common.Hash{0x00}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x00}, Number: big.NewInt(1), Hash: common.Hash{0x01}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0x02}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0xAB}, Number: big.NewInt(3), Hash: common.Hash{0xCD}}},
+	}
+
+	// children before their parents
+	shuffled := []types.Block{blocks[5], blocks[3], blocks[1], blocks[4], blocks[0], blocks[2]}
+
+	bt, err := Rebuild(shuffled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.head.hash != zeroHash || bt.NodeCount() != len(blocks) {
+		t.Errorf("Fail: got root 0x%X with %d nodes expected 0x00 with %d", bt.head.hash, bt.NodeCount(), len(blocks))
+	}
+	for _, block := range blocks[1:] {
+		n := bt.GetNode(block.Header.Hash)
+		if n == nil {
+			t.Fatalf("Fail: block 0x%X not in tree", block.Header.Hash)
+		}
+		if n.parent.hash != block.Header.ParentHash || n.depth.Cmp(block.Header.Number) != 0 {
+			t.Errorf("Fail: block 0x%X got parent 0x%X depth %s", block.Header.Hash, n.parent.hash, n.depth)
+		}
+	}
+	expected := []common.Hash{{0x03}, {0xCD}}
+	if leaves := bt.GetLeaves(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Fail: got %v expected %v", leaves, expected)
+	}
+}
+
+func TestRebuild_MissingParent(t *testing.T) {
+	blocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}}},
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(0), Hash: common.Hash{0x00}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x00}, Number: big.NewInt(1), Hash: common.Hash{0x01}}},
+	}
+
+	_, err := Rebuild(blocks)
+	if !errors.Is(err, ErrParentNotFound) {
+		t.Errorf("expected %v, got %v", ErrParentNotFound, err)
+	}
+
+	_, err = Rebuild(append(blocks[1:], blocks[2]))
+	if !errors.Is(err, ErrBlockExists) {
+		t.Errorf("expected %v, got %v", ErrBlockExists, err)
+	}
+}
+
+// mockClock is a Clock always returning the same time
+type mockClock uint64
+
+func (c mockClock) Now() uint64 {
+	return uint64(c)
+}
+
+func TestRealClock_Milliseconds(t *testing.T) {
+	before := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	now := realClock{}.Now()
+	after := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if now < before || now > after {
+		t.Errorf("Fail: got %d expected between %d and %d", now, before, after)
+	}
+}
+
+func TestBlockTree_AddBlockArrivalTime(t *testing.T) {
+	bt := createFlatTree(t, 1)
+	bt.SetClock(mockClock(1000))
+
+	block := types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0x02}}}
+	err := bt.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivalTime, err := bt.GetArrivalTime(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 1000 {
+		t.Errorf("Fail: got %d expected 1000", arrivalTime)
+	}
+
+	// an explicit arrival time overrides the clock
+	block = types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}}}
+	err = bt.AddBlockWithArrivalTime(block, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivalTime, err = bt.GetArrivalTime(common.Hash{0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 42 {
+		t.Errorf("Fail: got %d expected 42", arrivalTime)
+	}
+}
+
+func TestBlockTree_GetBlockInfo(t *testing.T) {
+	bt := createForkedTree(t)
+
+	info, err := bt.GetBlockInfo(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BlockInfo{
+		Hash:        common.Hash{0x01},
+		ParentHash:  zeroHash,
+		Number:      big.NewInt(1),
+		ArrivalTime: bt.GetNode(common.Hash{0x01}).arrivalTime,
+		Children:    []common.Hash{{0x02}, {0xCD}},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("Fail: got %+v expected %+v", info, expected)
+	}
+
+	// the info is a copy
+	info.Number.SetInt64(99)
+	info.Children[0] = common.Hash{0x99}
+	if bt.GetNode(common.Hash{0x01}).number.Int64() != 1 || bt.GetNode(common.Hash{0x01}).children[0].hash != (common.Hash{0x02}) {
+		t.Error("Fail: changing the info changed the tree")
+	}
+
+	info, err = bt.GetBlockInfo(common.Hash{0xEF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = BlockInfo{Hash: common.Hash{0xEF}, ParentHash: common.Hash{0xCD}, Children: []common.Hash{}, ArrivalTime: info.ArrivalTime}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("Fail: got %+v expected %+v", info, expected)
+	}
+
+	_, err = bt.GetBlockInfo(common.Hash{0x99})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_WalkAncestors(t *testing.T) {
+	bt := createForkedTree(t)
+
+	var visited []common.Hash
+	err := bt.WalkAncestors(common.Hash{0xEF}, func(info *BlockInfo) bool {
+		visited = append(visited, info.Hash)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []common.Hash{{0xEF}, {0xCD}, {0x01}, zeroHash}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Fail: got %v expected %v", visited, expected)
+	}
+
+	// stop at the first block that arrived at the given time
+	visited = nil
+	err = bt.WalkAncestors(common.Hash{0xEF}, func(info *BlockInfo) bool {
+		visited = append(visited, info.Hash)
+		return info.ArrivalTime != 1234
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []common.Hash{{0xEF}, {0xCD}}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Fail: got %v expected %v", visited, expected)
+	}
+
+	err = bt.WalkAncestors(common.Hash{0x99}, func(info *BlockInfo) bool {
+		t.Errorf("expected no visit, got 0x%X", info.Hash)
+		return true
+	})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_ExportChain(t *testing.T) {
+	bt := createForkedTree(t)
+
+	tests := []struct {
+		tip      common.Hash
+		expected []common.Hash
+	}{
+		{common.Hash{0x03}, []common.Hash{zeroHash, {0x01}, {0x02}, {0x03}}},
+		{common.Hash{0xEF}, []common.Hash{zeroHash, {0x01}, {0xCD}, {0xEF}}},
+		{zeroHash, []common.Hash{zeroHash}},
+	}
+	for _, test := range tests {
+		chain, err := bt.ExportChain(test.tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := make([]common.Hash, len(chain))
+		for i, info := range chain {
+			hashes[i] = info.Hash
+			expected, err := bt.GetBlockInfo(info.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(info, expected) {
+				t.Errorf("Fail: got %+v expected %+v", info, expected)
+			}
+		}
+		if !reflect.DeepEqual(hashes, test.expected) {
+			t.Errorf("Fail: got %v expected %v", hashes, test.expected)
+		}
+	}
+
+	// the depth is relative to the root after finalizing
+	err := bt.Finalize(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := bt.ExportChain(common.Hash{0xEF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || chain[0].Hash != (common.Hash{0x01}) {
+		t.Errorf("expected chain from 0x01 of 3 blocks, got %+v", chain)
+	}
+
+	_, err = bt.ExportChain(common.Hash{0x99})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_Clone(t *testing.T) {
+	bt := createForkedTree(t)
+	err := bt.Finalize(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := bt.Clone()
+
+	compareNodes(t, bt.head, clone.head)
+	if clone.DeepestLeaf().hash != bt.DeepestLeaf().hash {
+		t.Errorf("expected deepest leaf 0x%X, got 0x%X", bt.DeepestLeaf().hash, clone.DeepestLeaf().hash)
+	}
+	if clone.Finalized() != bt.Finalized() || clone.LeafCount() != bt.LeafCount() {
+		t.Errorf("expected clone %s to match %s", clone, bt)
+	}
+	for hash, leaf := range clone.leaves {
+		if leaf == bt.leaves[hash] || leaf != clone.GetNode(hash) {
+			t.Errorf("expected leaf 0x%X to be a node of the clone", hash)
+		}
+	}
+
+	// an insert on the clone makes a new deepest leaf there only
+	block := types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0xEF}, Number: big.NewInt(4), Hash: common.Hash{0xF0}}}
+	err = clone.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.DeepestLeaf().hash != (common.Hash{0xF0}) {
+		t.Errorf("expected deepest leaf of the clone 0xF0, got 0x%X", clone.DeepestLeaf().hash)
+	}
+	if bt.DeepestLeaf().hash != (common.Hash{0x03}) || bt.GetNode(common.Hash{0xF0}) != nil {
+		t.Errorf("expected the original to be unchanged, got %s", bt)
+	}
+
+	// arrival times are copied, not shared
+	err = clone.SetArrivalTime(common.Hash{0xCD}, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivalTime, err := bt.GetArrivalTime(common.Hash{0xCD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 1234 {
+		t.Errorf("Fail: got %d expected 1234", arrivalTime)
+	}
+
+	// finalizing the original doesn't prune the clone
+	err = bt.Finalize(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.GetNode(common.Hash{0xCD}) == nil || clone.Finalized() != (common.Hash{0x01}) {
+		t.Errorf("expected the clone to be unchanged, got %s", clone)
+	}
+}
+
 func TestBlockTree_AddBlock(t *testing.T) {
 	bt := createFlatTree(t, 1)
 
@@ -114,7 +532,10 @@ func TestBlockTree_AddBlock(t *testing.T) {
 		Body: types.BlockBody{},
 	}
 
-	bt.AddBlock(block)
+	err := bt.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	n := bt.GetNode(common.Hash{0x02})
 
@@ -129,6 +550,95 @@ func TestBlockTree_AddBlock(t *testing.T) {
 	}
 }
 
+func TestBlockTree_RemoveBlock(t *testing.T) {
+	bt := createForkedTree(t)
+
+	// a leaf
+	err := bt.RemoveBlock(common.Hash{0xAB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.GetNode(common.Hash{0xAB}) != nil || bt.leaves[common.Hash{0xAB}] != nil {
+		t.Error("expected 0xAB to be removed")
+	}
+	if len(bt.head.children) != 1 {
+		t.Errorf("expected 1 child of the root, got %d", len(bt.head.children))
+	}
+
+	// a block on the best chain with a subtree, the other fork becomes the best chain
+	err = bt.RemoveBlock(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []common.Hash{{0x02}, {0x03}} {
+		if bt.GetNode(h) != nil {
+			t.Errorf("expected 0x%X to be removed", h)
+		}
+	}
+	if bt.LeafCount() != 1 || bt.DeepestLeaf().hash != (common.Hash{0xEF}) {
+		t.Errorf("expected 0xEF to be the only leaf, got %v", bt.GetLeaves())
+	}
+
+	// the parent of the last subtree becomes a leaf
+	err = bt.RemoveBlock(common.Hash{0xCD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.NodeCount() != 2 || bt.DeepestLeaf().hash != (common.Hash{0x01}) {
+		t.Errorf("expected 0x01 to be the only leaf, got %s", bt)
+	}
+
+	err = bt.RemoveBlock(common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+	err = bt.RemoveBlock(zeroHash)
+	if err == nil {
+		t.Error("expected an error removing the root")
+	}
+}
+
+func TestBlockTree_AddBlock_Invalid(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	orphan := types.Block{
+		Header: types.BlockHeader{ParentHash: common.Hash{0xEE}, Number: big.NewInt(3), Hash: common.Hash{0xAB}},
+	}
+	err := bt.AddBlock(orphan)
+	if !errors.Is(err, ErrParentNotFound) {
+		t.Errorf("expected %v, got %v", ErrParentNotFound, err)
+	}
+	if bt.GetNode(common.Hash{0xAB}) != nil {
+		t.Errorf("expected orphan not to be added")
+	}
+
+	// adding the same block twice, or another block with the same hash, leaves the tree untouched
+	duplicates := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0x02}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x00}, Number: big.NewInt(1), Hash: common.Hash{0x02}}},
+	}
+	for _, block := range duplicates {
+		err = bt.AddBlock(block)
+		if !errors.Is(err, ErrBlockExists) {
+			t.Errorf("expected %v, got %v", ErrBlockExists, err)
+		}
+	}
+	if bt.NodeCount() != 3 || bt.GetNode(common.Hash{0x02}).parent.hash != (common.Hash{0x01}) {
+		t.Errorf("expected duplicates not to change the tree, got %s", bt.Tree())
+	}
+
+	child := types.Block{
+		Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}},
+	}
+	err = bt.AddBlock(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.GetNode(common.Hash{0x03}) == nil {
+		t.Errorf("expected valid child to be added")
+	}
+}
+
 func TestNode_isDecendantOf(t *testing.T) {
 	// Create tree with depth 4 (with 4 nodes)
 	bt := createFlatTree(t, 4)
@@ -165,7 +675,10 @@ func TestBlockTree_LongestPath(t *testing.T) {
 		Body: types.BlockBody{},
 	}
 
-	bt.AddBlock(extraBlock)
+	err := bt.AddBlock(extraBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expectedPath := []*node{
 		bt.GetNode(common.Hash{0x00}),
@@ -183,30 +696,1017 @@ func TestBlockTree_LongestPath(t *testing.T) {
 	}
 }
 
-// TODO: Need to define leftmost (see BlockTree.LongestPath)
-//func TestBlockTree_LongestPath_LeftMost(t *testing.T) {
-//	bt := createFlatTree(t, 1)
-//
-//	// Insert a block to create a competing path
-//	extraBlock := types.Block{
-//		SlotNumber:   nil,
-//		ParentHash: zeroHash,
-//		Number:  big.NewInt(1),
-//		Hash:         common.Hash{0xAB},
-//	}
-//
-//	bt.AddBlock(extraBlock)
-//
-//	expectedPath := []*node{
-//		bt.GetNode(common.Hash{0x00}),
-//		bt.GetNode(common.Hash{0xAB}),
-//	}
-//
-//	longestPath := bt.LongestPath()
-//
-//	for i, n := range longestPath {
-//		if n.hash != expectedPath[i].hash {
-//			t.Errorf("expected hash: 0x%X got: 0x%X\n", expectedPath[i].hash, n.hash)
-//		}
-//	}
-//}
+func TestBlockTree_GetLeaves(t *testing.T) {
+	bt := createFlatTree(t, 3)
+
+	leaves := bt.GetLeaves()
+	expected := []common.Hash{{0x03}}
+	if !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Fail: got %v expected %v", leaves, expected)
+	}
+
+	// three-way fork off block 1, with two tips at the same depth
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xCD}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leaves = bt.GetLeaves()
+	expected = []common.Hash{{0xAB}, {0xCD}, {0x03}}
+	if !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Fail: got %v expected %v", leaves, expected)
+	}
+}
+
+func TestBlockTree_Metrics(t *testing.T) {
+	bt := createFlatTree(t, 4)
+
+	if bt.NodeCount() != 5 || bt.LeafCount() != 1 || bt.Depth() != 4 {
+		t.Errorf("Fail: linear chain got %d nodes, %d leaves, depth %d expected 5, 1, 4", bt.NodeCount(), bt.LeafCount(), bt.Depth())
+	}
+
+	// fork off blocks 0 and 2
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0xCD}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0xCD}, Number: big.NewInt(4), Hash: common.Hash{0xCE}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bt.NodeCount() != 8 || bt.LeafCount() != 3 || bt.Depth() != 4 {
+		t.Errorf("Fail: forked tree got %d nodes, %d leaves, depth %d expected 8, 3, 4", bt.NodeCount(), bt.LeafCount(), bt.Depth())
+	}
+
+	// pruning drops the fork off block 0
+	bt.Prune(3)
+
+	if bt.NodeCount() != 6 || bt.LeafCount() != 2 || bt.Depth() != 3 {
+		t.Errorf("Fail: pruned tree got %d nodes, %d leaves, depth %d expected 6, 2, 3", bt.NodeCount(), bt.LeafCount(), bt.Depth())
+	}
+}
+
+func TestBlockTree_ArrivalTime(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	arrivalTime, err := bt.GetArrivalTime(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime == 0 {
+		t.Errorf("expected arrival time to be set when adding block")
+	}
+
+	err = bt.SetArrivalTime(common.Hash{0x02}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arrivalTime, err = bt.GetArrivalTime(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 1000 {
+		t.Errorf("Fail: got %d expected %d", arrivalTime, 1000)
+	}
+
+	_, err = bt.GetArrivalTime(common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+	err = bt.SetArrivalTime(common.Hash{0xEE}, 1000)
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_ApplyArrivalTimes(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	times := map[common.Hash]uint64{{0x00}: 100, {0x01}: 200, {0x02}: 300}
+	err := bt.ApplyArrivalTimes(times)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, expected := range times {
+		arrivalTime, err := bt.GetArrivalTime(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arrivalTime != expected {
+			t.Errorf("Fail: got %d expected %d for 0x%x", arrivalTime, expected, h)
+		}
+	}
+
+	// the blocks that are found are still updated
+	err = bt.ApplyArrivalTimes(map[common.Hash]uint64{{0xEF}: 1, {0x01}: 400, {0xEE}: 1})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+	for _, h := range []common.Hash{{0xEE}, {0xEF}} {
+		if !strings.Contains(err.Error(), fmt.Sprintf("0x%x", h)) {
+			t.Errorf("expected error to name 0x%x, got %v", h, err)
+		}
+	}
+	if strings.Contains(err.Error(), fmt.Sprintf("0x%x", common.Hash{0x01})) {
+		t.Errorf("expected error not to name 0x%x, got %v", common.Hash{0x01}, err)
+	}
+	arrivalTime, err := bt.GetArrivalTime(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 400 {
+		t.Errorf("Fail: got %d expected 400", arrivalTime)
+	}
+
+	// an empty map changes nothing
+	err = bt.ApplyArrivalTimes(map[common.Hash]uint64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivalTime, err = bt.GetArrivalTime(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivalTime != 300 {
+		t.Errorf("Fail: got %d expected 300", arrivalTime)
+	}
+}
+
+func TestBlockTree_ToDOT(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	// fork off the genesis block
+	err := bt.AddBlock(types.Block{
+		Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0xAB}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []common.Hash{{0x00}, {0x01}, {0x02}, {0xAB}} {
+		err := bt.SetArrivalTime(h, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// node identifiers are the quoted full hashes
+	id := func(b byte) string {
+		return fmt.Sprintf(`"0x%02x%s"`, b, strings.Repeat("00", 31))
+	}
+	expected := []string{
+		"digraph BlockTree {\n",
+		id(0x00) + ` [label="0x00000000\nnumber: 0\narrival: 100"];`,
+		id(0x01) + ` [label="0x01000000\nnumber: 1\narrival: 100"];`,
+		id(0x02) + ` [label="0x02000000\nnumber: 2\narrival: 100", style=filled, fillcolor="green"];`,
+		id(0xAB) + ` [label="0xab000000\nnumber: 1\narrival: 100"];`,
+		id(0x00) + ` -> ` + id(0x01) + `;`,
+		id(0x01) + ` -> ` + id(0x02) + `;`,
+		id(0x00) + ` -> ` + id(0xAB) + `;`,
+	}
+
+	dot := bt.ToDOT()
+	for _, e := range expected {
+		if !strings.Contains(dot, e) {
+			t.Errorf("expected DOT output to contain %s\ngot:\n%s", e, dot)
+		}
+	}
+
+	err = bt.Finalize(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot = bt.ToDOT()
+	if !strings.Contains(dot, id(0x01)+` [label="0x01000000\nnumber: 1\narrival: 100", style=filled, fillcolor="lightblue"];`) {
+		t.Errorf("expected finalized root to be highlighted, got:\n%s", dot)
+	}
+	if strings.Contains(dot, "0xab") {
+		t.Errorf("expected pruned fork to be absent, got:\n%s", dot)
+	}
+}
+
+func TestBlockTree_IsDescendantOf(t *testing.T) {
+	bt := createFlatTree(t, 4)
+
+	// fork off block 1
+	err := bt.AddBlock(types.Block{
+		Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ancestor   common.Hash
+		descendant common.Hash
+		expected   bool
+	}{
+		{ancestor: common.Hash{0x01}, descendant: common.Hash{0x02}, expected: true},  // direct child
+		{ancestor: common.Hash{0x00}, descendant: common.Hash{0x04}, expected: true},  // distant descendant
+		{ancestor: common.Hash{0x03}, descendant: common.Hash{0x03}, expected: true},  // itself
+		{ancestor: common.Hash{0x04}, descendant: common.Hash{0x01}, expected: false}, // ancestor
+		{ancestor: common.Hash{0x02}, descendant: common.Hash{0xAB}, expected: false}, // unrelated fork
+		{ancestor: common.Hash{0x01}, descendant: common.Hash{0xAB}, expected: true},
+	}
+
+	for _, test := range testCases {
+		res, err := bt.IsDescendantOf(test.ancestor, test.descendant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != test.expected {
+			t.Errorf("Fail: 0x%X descendant of 0x%X got %v expected %v", test.descendant, test.ancestor, res, test.expected)
+		}
+	}
+
+	_, err = bt.IsDescendantOf(common.Hash{0xEE}, common.Hash{0x01})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v for unknown ancestor, got %v", ErrNodeNotFound, err)
+	}
+	_, err = bt.IsDescendantOf(common.Hash{0x01}, common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v for unknown descendant, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_GetBlockDepth(t *testing.T) {
+	bt := createForkedTree(t)
+
+	testCases := []struct {
+		hash     common.Hash
+		expected uint64
+	}{
+		{hash: zeroHash, expected: 0},
+		{hash: common.Hash{0xAB}, expected: 1},
+		{hash: common.Hash{0x03}, expected: 3},
+		{hash: common.Hash{0xEF}, expected: 3},
+	}
+	for _, test := range testCases {
+		depth, err := bt.GetBlockDepth(test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != test.expected {
+			t.Errorf("Fail: 0x%X got %d expected %d", test.hash, depth, test.expected)
+		}
+	}
+
+	_, err := bt.GetBlockDepth(common.Hash{0x99})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+
+	// after re-rooting at 0x01 depths are measured from the new root
+	bt.Prune(2)
+	if bt.head.hash != (common.Hash{0x01}) {
+		t.Fatalf("expected root 0x01, got %s", bt.head)
+	}
+	for hash, expected := range map[common.Hash]uint64{{0x01}: 0, {0x03}: 2, {0xEF}: 2} {
+		depth, err := bt.GetBlockDepth(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != expected {
+			t.Errorf("Fail: 0x%X got %d expected %d", hash, depth, expected)
+		}
+	}
+}
+
+func TestBlockTree_Prune(t *testing.T) {
+	bt := createFlatTree(t, 6)
+
+	// fork off blocks 1 and 4
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x04}, Number: big.NewInt(5), Hash: common.Hash{0xCD}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(bt.leaves) != 3 {
+		t.Fatalf("expected 3 leaves, got %d", len(bt.leaves))
+	}
+
+	bt.Prune(3)
+
+	if bt.head.hash != (common.Hash{0x03}) || bt.head.parent != nil {
+		t.Errorf("expected 0x03 to be the parentless root, got %s", bt.head)
+	}
+	for _, h := range []common.Hash{{0x00}, {0x01}, {0x02}, {0xAB}} {
+		if bt.GetNode(h) != nil {
+			t.Errorf("expected 0x%X to be pruned", h)
+		}
+	}
+	if len(bt.leaves) != 2 {
+		t.Errorf("expected 2 leaves, got %d", len(bt.leaves))
+	}
+
+	expectedPath := []common.Hash{{0x03}, {0x04}, {0x05}, {0x06}}
+	longestChain := bt.LongestChain()
+	if len(longestChain) != len(expectedPath) {
+		t.Fatalf("expected path of length %d got: %d", len(expectedPath), len(longestChain))
+	}
+	for i, n := range longestChain {
+		if n.hash != expectedPath[i] {
+			t.Errorf("expected hash: 0x%X got: 0x%X\n", expectedPath[i], n.hash)
+		}
+	}
+
+	// the fork within maxDepth is kept
+	if bt.GetNode(common.Hash{0xCD}) == nil {
+		t.Errorf("expected 0xCD to survive pruning")
+	}
+
+	// pruning to a depth beyond the root is a no-op
+	bt.Prune(10)
+	if bt.head.hash != (common.Hash{0x03}) {
+		t.Errorf("expected root to stay 0x03, got %s", bt.head)
+	}
+
+	// pruning to depth 0 leaves only the deepest leaf
+	bt.Prune(0)
+	if bt.head.hash != (common.Hash{0x06}) || len(bt.leaves) != 1 {
+		t.Errorf("expected only 0x06 to remain, got %s", bt.Tree())
+	}
+}
+
+func TestBlockTree_Prune_Finalized(t *testing.T) {
+	bt := createFlatTree(t, 6)
+
+	err := bt.Finalize(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the finalized root isn't pruned, the blocks after it aren't finalized
+	bt.Prune(2)
+	if bt.head.hash != (common.Hash{0x01}) {
+		t.Errorf("expected root to stay 0x01, got %s", bt.head)
+	}
+	if finalized := bt.Finalized(); bt.GetNode(finalized) == nil {
+		t.Errorf("expected finalized block 0x%X to be in the tree", finalized)
+	}
+	marker := fmt.Sprintf(`"0x01%s" [label="0x01000000\nnumber: 1\narrival: %d", style=filled, fillcolor="lightblue"];`,
+		strings.Repeat("00", 31), bt.head.arrivalTime)
+	if dot := bt.ToDOT(); !strings.Contains(dot, marker) {
+		t.Errorf("expected DOT output to contain %s\ngot:\n%s", marker, dot)
+	}
+}
+
+func TestBlockTree_OnReorg(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	type reorg struct {
+		oldBest, newBest, commonAncestor common.Hash
+	}
+	var reorgs []reorg
+	bt.OnReorg(func(oldBest, newBest, commonAncestor common.Hash) {
+		reorgs = append(reorgs, reorg{oldBest, newBest, commonAncestor})
+	})
+
+	blocks := []struct {
+		block    types.Block
+		expected []reorg
+	}{
+		// extending the best chain
+		{
+			block:    types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}}},
+			expected: nil,
+		},
+		// a shorter fork
+		{
+			block:    types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+			expected: nil,
+		},
+		{
+			block:    types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0xAB}, Number: big.NewInt(3), Hash: common.Hash{0xAC}}},
+			expected: nil,
+		},
+		// the fork overtakes the best chain
+		{
+			block:    types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0xAC}, Number: big.NewInt(4), Hash: common.Hash{0xAD}}},
+			expected: []reorg{{common.Hash{0x03}, common.Hash{0xAD}, common.Hash{0x01}}},
+		},
+	}
+
+	for _, b := range blocks {
+		reorgs = nil
+		err := bt.AddBlock(b.block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reorgs, b.expected) {
+			t.Errorf("Fail: adding 0x%X got %v expected %v", b.block.Header.Hash, reorgs, b.expected)
+		}
+	}
+}
+
+func TestBlockTree_HighestCommonAncestor(t *testing.T) {
+	bt := createFlatTree(t, 4)
+
+	// fork off block 1
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0xAB}, Number: big.NewInt(3), Hash: common.Hash{0xAC}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		a, b     common.Hash
+		expected common.Hash
+	}{
+		{a: common.Hash{0x02}, b: common.Hash{0x04}, expected: common.Hash{0x02}}, // same chain
+		{a: common.Hash{0x04}, b: common.Hash{0x02}, expected: common.Hash{0x02}},
+		{a: common.Hash{0x03}, b: common.Hash{0x03}, expected: common.Hash{0x03}},
+		{a: common.Hash{0x04}, b: common.Hash{0xAC}, expected: common.Hash{0x01}}, // forked
+		{a: common.Hash{0xAB}, b: common.Hash{0x02}, expected: common.Hash{0x01}},
+	}
+
+	for _, test := range testCases {
+		res, err := bt.HighestCommonAncestor(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != test.expected {
+			t.Errorf("Fail: ancestor of 0x%X and 0x%X got 0x%X expected 0x%X", test.a, test.b, res, test.expected)
+		}
+	}
+
+	_, err := bt.HighestCommonAncestor(common.Hash{0x04}, common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestNode_CommonAncestor_Disjoint(t *testing.T) {
+	a := createFlatTree(t, 2).GetNode(common.Hash{0x02})
+	b := createFlatTree(t, 2).GetNode(common.Hash{0x02})
+
+	if ancestor := a.commonAncestor(b); ancestor != nil {
+		t.Errorf("Fail: disjoint trees got ancestor %s expected none", ancestor)
+	}
+}
+
+func TestBlockTree_Subscribe(t *testing.T) {
+	bt := createFlatTree(t, 1)
+
+	ch, unsubscribe := bt.Subscribe()
+	defer unsubscribe()
+
+	expected := []common.Hash{{0x02}, {0x03}, {0xAB}}
+	blocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0x02}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0x03}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+	}
+	for _, block := range blocks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, h := range expected {
+		select {
+		case res := <-ch:
+			if res != h {
+				t.Errorf("Fail: got 0x%X expected 0x%X", res, h)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for 0x%X", h)
+		}
+	}
+}
+
+func TestBlockTree_Unsubscribe(t *testing.T) {
+	bt := createFlatTree(t, 1)
+
+	ch, unsubscribe := bt.Subscribe()
+	unsubscribe()
+	// unsubscribing twice is harmless
+	unsubscribe()
+
+	err := bt.AddBlock(types.Block{
+		Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0x02}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h, ok := <-ch; ok {
+		t.Errorf("Fail: got 0x%X after unsubscribing", h)
+	}
+}
+
+func TestBlockTree_Subscribe_SlowSubscriber(t *testing.T) {
+	bt := createFlatTree(t, 0)
+
+	ch, unsubscribe := bt.Subscribe()
+	defer unsubscribe()
+
+	// adding more blocks than the buffer holds doesn't block
+	previous := common.Hash{0x00}
+	for i := 1; i <= subscriberBuffer+5; i++ {
+		h := common.Hash{0x01, byte(i)}
+		err := bt.AddBlock(types.Block{
+			Header: types.BlockHeader{ParentHash: previous, Number: big.NewInt(int64(i)), Hash: h},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous = h
+	}
+
+	if len(ch) != subscriberBuffer {
+		t.Errorf("Fail: got %d buffered hashes expected %d", len(ch), subscriberBuffer)
+	}
+}
+
+func TestBlockTree_LowestBranchPoint(t *testing.T) {
+	bt := createFlatTree(t, 3)
+	if h, ok := bt.LowestBranchPoint(); ok {
+		t.Errorf("expected no branch point in a linear chain, got 0x%X", h)
+	}
+
+	// a single fork at 0x02
+	err := bt.AddBlock(types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0xAB}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := bt.LowestBranchPoint(); !ok || h != (common.Hash{0x02}) {
+		t.Errorf("expected branch point 0x02, got 0x%X %v", h, ok)
+	}
+
+	// nested forks, the one closest to the root is returned
+	bt = createForkedTree(t)
+	if h, ok := bt.LowestBranchPoint(); !ok || h != zeroHash {
+		t.Errorf("expected branch point 0x%X, got 0x%X %v", zeroHash, h, ok)
+	}
+	err = bt.RemoveBlock(common.Hash{0xAB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := bt.LowestBranchPoint(); !ok || h != (common.Hash{0x01}) {
+		t.Errorf("expected branch point 0x01, got 0x%X %v", h, ok)
+	}
+}
+
+func TestBlockTree_AddBlock_ValidatesNumber(t *testing.T) {
+	bt := createFlatTree(t, 2)
+
+	for _, number := range []int64{4, 2} {
+		block := types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(number), Hash: common.Hash{0xAB}}}
+		err := bt.AddBlock(block)
+		if !errors.Is(err, ErrInvalidBlockNumber) {
+			t.Errorf("Fail: number %d got %v expected %v", number, err, ErrInvalidBlockNumber)
+		}
+		if bt.GetNode(common.Hash{0xAB}) != nil {
+			t.Errorf("Fail: block with number %d was added", number)
+		}
+	}
+
+	block := types.Block{Header: types.BlockHeader{ParentHash: common.Hash{0x02}, Number: big.NewInt(3), Hash: common.Hash{0xAB}}}
+	err := bt.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.DeepestLeaf().hash != (common.Hash{0xAB}) {
+		t.Errorf("Fail: got deepest leaf 0x%X expected 0xAB", bt.DeepestLeaf().hash)
+	}
+}
+
+func TestBlockTree_FindByAuthor(t *testing.T) {
+	bt := createFlatTree(t, 0)
+	alice, bob := AuthorityID{0xA1}, AuthorityID{0xB0}
+
+	// two forks off the genesis block, with authors alternating along each
+	blocks := []struct {
+		parent, hash common.Hash
+		number       int64
+		author       AuthorityID
+	}{
+		{zeroHash, common.Hash{0x01}, 1, alice},
+		{zeroHash, common.Hash{0xAB}, 1, bob},
+		{common.Hash{0x01}, common.Hash{0x02}, 2, bob},
+		{common.Hash{0xAB}, common.Hash{0xCD}, 2, alice},
+		{common.Hash{0x02}, common.Hash{0x03}, 3, alice},
+	}
+	for _, b := range blocks {
+		err := bt.AddBlockWithAuthor(types.Block{Header: types.BlockHeader{ParentHash: b.parent, Number: big.NewInt(b.number), Hash: b.hash}}, b.author)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []common.Hash{{0x01}, {0xCD}, {0x03}}
+	if res := bt.FindByAuthor(alice); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Fail: got %v expected %v", res, expected)
+	}
+	expected = []common.Hash{{0xAB}, {0x02}}
+	if res := bt.FindByAuthor(bob); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Fail: got %v expected %v", res, expected)
+	}
+	if res := bt.FindByAuthor(AuthorityID{0xC0}); len(res) != 0 {
+		t.Errorf("Fail: got %v expected no blocks", res)
+	}
+
+	info, err := bt.GetBlockInfo(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Author != bob {
+		t.Errorf("Fail: got author %x expected %x", info.Author, bob)
+	}
+}
+
+func TestBlockTree_GetAllBlocksAtDepth(t *testing.T) {
+	bt := createFlatTree(t, 3)
+
+	// fork off the genesis block at depth 1 and block 1 at depth 2
+	extraBlocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xCD}}},
+	}
+	for _, block := range extraBlocks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		depth    int64
+		expected []common.Hash
+	}{
+		{depth: 0, expected: []common.Hash{{0x00}}},
+		{depth: 1, expected: []common.Hash{{0x01}, {0xAB}}},
+		{depth: 2, expected: []common.Hash{{0x02}, {0xCD}}},
+		{depth: 3, expected: []common.Hash{{0x03}}},
+		{depth: 4, expected: []common.Hash{}},
+	}
+
+	for _, test := range testCases {
+		hashes := bt.GetAllBlocksAtDepth(big.NewInt(test.depth))
+		if hashes == nil {
+			t.Fatalf("expected non-nil slice at depth %d", test.depth)
+		}
+		if !reflect.DeepEqual(hashes, test.expected) {
+			t.Errorf("Fail: depth %d got %v expected %v", test.depth, hashes, test.expected)
+		}
+	}
+}
+
+func TestBlockTree_GetAllBlocksAtDepth_NonZeroRoot(t *testing.T) {
+	d := &db.BlockDB{
+		Db: db.NewMemDatabase(),
+	}
+	bt := NewBlockTreeFromGenesis(types.Block{Header: types.BlockHeader{Number: big.NewInt(100), Hash: common.Hash{0x10}}}, d)
+
+	// the fork at 0xAB is added before the block it competes with, but comes later in the children of 0x10
+	blocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x10}, Number: big.NewInt(101), Hash: common.Hash{0x11}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x10}, Number: big.NewInt(101), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0xAB}, Number: big.NewInt(102), Hash: common.Hash{0xAC}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x11}, Number: big.NewInt(102), Hash: common.Hash{0x12}}},
+	}
+	for _, block := range blocks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		number   int64
+		expected []common.Hash
+	}{
+		{number: 0, expected: []common.Hash{}},
+		{number: 1, expected: []common.Hash{}},
+		{number: 100, expected: []common.Hash{{0x10}}},
+		{number: 101, expected: []common.Hash{{0x11}, {0xAB}}},
+		{number: 102, expected: []common.Hash{{0xAC}, {0x12}}},
+	}
+	for _, test := range testCases {
+		hashes := bt.GetAllBlocksAtDepth(big.NewInt(test.number))
+		if !reflect.DeepEqual(hashes, test.expected) {
+			t.Errorf("Fail: number %d got %v expected %v", test.number, hashes, test.expected)
+		}
+	}
+}
+
+func TestBlockTree_Finalize(t *testing.T) {
+	bt := createFlatTree(t, 4)
+
+	// fork off blocks 1 and 3
+	forks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x03}, Number: big.NewInt(4), Hash: common.Hash{0xCD}}},
+	}
+	for _, block := range forks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := bt.Finalize(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bt.head.hash != (common.Hash{0x02}) || bt.head.parent != nil {
+		t.Errorf("expected 0x02 to be the parentless root, got %s", bt.head)
+	}
+
+	for _, h := range []common.Hash{{0x00}, {0x01}, {0xAB}} {
+		if bt.GetNode(h) != nil {
+			t.Errorf("expected 0x%X to be pruned", h)
+		}
+		if bt.leaves[h] != nil {
+			t.Errorf("expected 0x%X to no longer be a leaf", h)
+		}
+	}
+	for _, h := range []common.Hash{{0x02}, {0x03}, {0x04}, {0xCD}} {
+		if bt.GetNode(h) == nil {
+			t.Errorf("expected 0x%X to survive finalization", h)
+		}
+	}
+	if len(bt.leaves) != 2 {
+		t.Errorf("expected 2 leaves, got %d", len(bt.leaves))
+	}
+
+	// the pruned path is kept detached
+	for _, n := range bt.finalizedBlocks[:2] {
+		if n.parent != nil || len(n.children) != 0 {
+			t.Errorf("expected finalized ancestor %s to be detached", n)
+		}
+	}
+
+	// finalizing an ancestor of the finalized block or the root is a no-op
+	for _, h := range []common.Hash{{0x01}, {0x02}} {
+		err = bt.Finalize(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bt.head.hash != (common.Hash{0x02}) {
+			t.Errorf("expected root to stay 0x02, got %s", bt.head)
+		}
+	}
+
+	err = bt.Finalize(common.Hash{0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bt.finalizedBlocks) != 4 {
+		t.Errorf("expected 4 finalized blocks, got %d", len(bt.finalizedBlocks))
+	}
+
+	err = bt.Finalize(common.Hash{0xEE})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+}
+
+func TestBlockTree_SetFinalized(t *testing.T) {
+	bt := createForkedTree(t)
+
+	// the root is considered finalized until another block is
+	if bt.Finalized() != zeroHash {
+		t.Errorf("expected finalized block 0x%X, got 0x%X", zeroHash, bt.Finalized())
+	}
+
+	err := bt.SetFinalized(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.Finalized() != (common.Hash{0x02}) {
+		t.Errorf("expected finalized block 0x02, got 0x%X", bt.Finalized())
+	}
+	for _, h := range []common.Hash{{0xAB}, {0xCD}, {0xEF}} {
+		if bt.GetNode(h) != nil {
+			t.Errorf("expected 0x%X to be pruned", h)
+		}
+	}
+
+	// finalizing the same block again is a no-op
+	err = bt.SetFinalized(common.Hash{0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// finalization can't move backwards
+	for _, h := range []common.Hash{zeroHash, {0x01}} {
+		err = bt.SetFinalized(h)
+		if !errors.Is(err, ErrNotFinalizedDescendant) {
+			t.Errorf("expected %v, got %v", ErrNotFinalizedDescendant, err)
+		}
+	}
+	err = bt.SetFinalized(common.Hash{0xCD})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("expected %v, got %v", ErrNodeNotFound, err)
+	}
+	if bt.Finalized() != (common.Hash{0x02}) {
+		t.Errorf("expected finalized block to stay 0x02, got 0x%X", bt.Finalized())
+	}
+
+	err = bt.SetFinalized(common.Hash{0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.Finalized() != (common.Hash{0x03}) || bt.head.hash != (common.Hash{0x03}) {
+		t.Errorf("expected finalized root 0x03, got 0x%X rooted at %s", bt.Finalized(), bt.head)
+	}
+}
+
+func TestBlockTree_LongestChain(t *testing.T) {
+	bt := createFlatTree(t, 3)
+
+	// fork off the genesis block with a shorter chain
+	extraBlock := types.Block{
+		Header: types.BlockHeader{
+			ParentHash: zeroHash,
+			Number:     big.NewInt(1),
+			Hash:       common.Hash{0xAB},
+		},
+		Body: types.BlockBody{},
+	}
+
+	err := bt.AddBlock(extraBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := []*node{
+		bt.GetNode(common.Hash{0x00}),
+		bt.GetNode(common.Hash{0x01}),
+		bt.GetNode(common.Hash{0x02}),
+		bt.GetNode(common.Hash{0x03}),
+	}
+
+	longestChain := bt.LongestChain()
+
+	if len(longestChain) != len(expectedPath) {
+		t.Fatalf("expected path of length %d got: %d", len(expectedPath), len(longestChain))
+	}
+	for i, n := range longestChain {
+		if n.hash != expectedPath[i].hash {
+			t.Errorf("expected hash: 0x%X got: 0x%X\n", expectedPath[i].hash, n.hash)
+		}
+	}
+}
+
+func TestBlockTree_RangeByNumber(t *testing.T) {
+	bt := createFlatTree(t, 4)
+
+	// a fork that isn't on the best chain
+	err := bt.AddBlock(types.Block{
+		Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xAB}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := bt.RangeByNumber(big.NewInt(1), big.NewInt(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []common.Hash{{0x01}, {0x02}, {0x03}}
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("Fail: got %v expected %v", hashes, expected)
+	}
+
+	hashes, err = bt.RangeByNumber(big.NewInt(4), big.NewInt(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []common.Hash{{0x04}}
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("Fail: got %v expected %v", hashes, expected)
+	}
+
+	_, err = bt.RangeByNumber(big.NewInt(3), big.NewInt(1))
+	if err == nil {
+		t.Errorf("Fail: expected error for an inverted range")
+	}
+	_, err = bt.RangeByNumber(big.NewInt(3), big.NewInt(5))
+	if err == nil {
+		t.Errorf("Fail: expected error for a range past the tip")
+	}
+}
+
+func TestBlockTree_LongestChain_LowestHash(t *testing.T) {
+	bt := createFlatTree(t, 1)
+
+	// Insert blocks to create competing paths, with both a higher and a lower hash than 0x01
+	extraBlocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0x00, 0x01}}},
+	}
+
+	for _, block := range extraBlocks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedPath := []*node{
+		bt.GetNode(common.Hash{0x00}),
+		bt.GetNode(common.Hash{0x00, 0x01}),
+	}
+
+	// the choice must not depend on map iteration order
+	for j := 0; j < 10; j++ {
+		longestChain := bt.LongestChain()
+
+		if len(longestChain) != len(expectedPath) {
+			t.Fatalf("expected path of length %d got: %d", len(expectedPath), len(longestChain))
+		}
+		for i, n := range longestChain {
+			if n.hash != expectedPath[i].hash {
+				t.Errorf("expected hash: 0x%X got: 0x%X\n", expectedPath[i].hash, n.hash)
+			}
+		}
+	}
+}
+
+func TestBlockTree_DeepestLeaf_Tiebreak(t *testing.T) {
+	genesis := types.Block{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(0), Hash: zeroHash}}
+	// three leaves of equal depth, the one with the highest hash arriving first
+	tied := []struct {
+		hash        common.Hash
+		arrivalTime uint64
+	}{
+		{common.Hash{0x02}, 20},
+		{common.Hash{0xAB}, 10},
+		{common.Hash{0x01}, 30},
+	}
+
+	tests := []struct {
+		tiebreak Tiebreak
+		expected common.Hash
+	}{
+		{TiebreakByHash, common.Hash{0x01}},
+		{TiebreakByArrivalTime, common.Hash{0xAB}},
+	}
+
+	for _, test := range tests {
+		bt := NewBlockTreeWithTiebreak(genesis, nil, test.tiebreak)
+		for _, leaf := range tied {
+			block := types.Block{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: leaf.hash}}
+			err := bt.AddBlockWithArrivalTime(block, leaf.arrivalTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the choice must not depend on map iteration order
+		for j := 0; j < 10; j++ {
+			if dl := bt.DeepestLeaf(); dl.hash != test.expected {
+				t.Errorf("tiebreak %d: expected hash: 0x%X got: 0x%X", test.tiebreak, test.expected, dl.hash)
+			}
+			chain := bt.LongestChain()
+			if len(chain) != 2 || chain[1].hash != test.expected {
+				t.Errorf("tiebreak %d: expected longest chain to end in 0x%X", test.tiebreak, test.expected)
+			}
+		}
+	}
+}
+
+func TestBlockTree_DeepestLeaf_TiebreakByArrivalTime_EqualTimes(t *testing.T) {
+	genesis := types.Block{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(0), Hash: zeroHash}}
+	bt := NewBlockTreeWithTiebreak(genesis, nil, TiebreakByArrivalTime)
+	bt.SetClock(mockClock(1000))
+
+	for _, hash := range []common.Hash{{0xAB}, {0x01}, {0x02}} {
+		block := types.Block{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: hash}}
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// leaves arriving at the same time fall back to the lowest hash
+	if dl := bt.DeepestLeaf(); dl.hash != (common.Hash{0x01}) {
+		t.Errorf("expected hash: 0x%X got: 0x%X", common.Hash{0x01}, dl.hash)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package blocktree
+
+import (
+	"time"
+)
+
+// Clock provides the arrival time of blocks added to the BlockTree, so it can be set deterministically in tests
+type Clock interface {
+	Now() uint64 // milliseconds since the Unix epoch, like the BABE clock
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,269 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package blocktree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/ChainSafe/gossamer/common"
+)
+
+// ErrInvalidEncoding is returned when decoding bytes that aren't a valid BlockTree encoding
+var ErrInvalidEncoding = errors.New("invalid block tree encoding")
+
+// encodingVersion is the version byte in front of every encoding, changed whenever the format changes
+const encodingVersion = 1
+
+// rootParentIndex is the parent index stored for the root node
+const rootParentIndex = math.MaxUint32
+
+// authorLength is the length of an encoded block author
+const authorLength = 32
+
+// minNodeLength is the length of an encoded node with a nil block number
+const minNodeLength = common.HashLength + 4 + 1 + 8 + authorLength
+
+// Encode serializes the structure of the BlockTree. All integers are little endian:
+//
+//	[version: 1 byte][node count: uint32][root depth: bigint]
+//	per node, in depth-first order with children in insertion order:
+//	[hash: 32 bytes][parent index: uint32][number: bigint][arrival time: uint64][author: 32 bytes]
+//
+// where bigint is [present: 1 byte][length: uint32][big endian magnitude] and the root has
+// parent index 0xFFFFFFFF. The version is 1. The finalized blocks and the database are not encoded.
+func (bt *BlockTree) Encode() ([]byte, error) {
+	var nodes []*node
+	index := make(map[*node]uint32)
+	var collect func(n *node)
+	collect = func(n *node) {
+		index[n] = uint32(len(nodes))
+		nodes = append(nodes, n)
+		for _, child := range n.children {
+			collect(child)
+		}
+	}
+	collect(bt.head)
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(encodingVersion)
+	putUint32(buf, uint32(len(nodes)))
+	err := putBigInt(buf, bt.head.depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range nodes {
+		buf.Write(n.hash[:])
+		if n.parent == nil {
+			putUint32(buf, rootParentIndex)
+		} else {
+			putUint32(buf, index[n.parent])
+		}
+		err = putBigInt(buf, n.number)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode block 0x%x: %w", n.hash, err)
+		}
+		putUint64(buf, n.arrivalTime)
+		buf.Write(n.author[:])
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode rebuilds a BlockTree from the output of Encode, restoring the parent and child links and
+// the leaves. The returned BlockTree has no database set, and its blocks count as added in depth-first order.
+func Decode(in []byte) (*BlockTree, error) {
+	r := &decoder{in: in}
+
+	version, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	if version[0] != encodingVersion {
+		return nil, fmt.Errorf("unsupported version %d: %w", version[0], ErrInvalidEncoding)
+	}
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no root node: %w", ErrInvalidEncoding)
+	}
+	rootDepth, err := r.bigInt()
+	if err != nil {
+		return nil, err
+	}
+	if rootDepth == nil {
+		return nil, fmt.Errorf("missing root depth: %w", ErrInvalidEncoding)
+	}
+	// check the count against the remaining length before allocating
+	if uint64(count)*minNodeLength > uint64(len(r.in)) {
+		return nil, fmt.Errorf("%d nodes in %d bytes: %w", count, len(r.in), ErrInvalidEncoding)
+	}
+
+	nodes := make([]*node, count)
+	seen := make(map[common.Hash]bool, count)
+	bt := &BlockTree{
+		finalizedBlocks: []*node{},
+		leaves:          leafMap{},
+		clock:           realClock{},
+	}
+
+	for i := uint32(0); i < count; i++ {
+		n := &node{children: []*node{}}
+
+		hash, err := r.next(common.HashLength)
+		if err != nil {
+			return nil, err
+		}
+		copy(n.hash[:], hash)
+		if seen[n.hash] {
+			return nil, fmt.Errorf("duplicate block 0x%x: %w", n.hash, ErrInvalidEncoding)
+		}
+		seen[n.hash] = true
+
+		parentIndex, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if n.number, err = r.bigInt(); err != nil {
+			return nil, err
+		}
+		if n.arrivalTime, err = r.uint64(); err != nil {
+			return nil, err
+		}
+		author, err := r.next(authorLength)
+		if err != nil {
+			return nil, err
+		}
+		copy(n.author[:], author)
+
+		switch {
+		case i == 0 && parentIndex == rootParentIndex:
+			n.depth = rootDepth
+			bt.head = n
+		case i > 0 && parentIndex < i:
+			n.parent = nodes[parentIndex]
+			n.depth = new(big.Int).Add(n.parent.depth, big.NewInt(1))
+			n.parent.addChild(n)
+		default:
+			return nil, fmt.Errorf("node %d has parent index %d: %w", i, parentIndex, ErrInvalidEncoding)
+		}
+		nodes[i] = n
+	}
+
+	if len(r.in) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes: %w", len(r.in), ErrInvalidEncoding)
+	}
+
+	// the insertion order isn't encoded, blocks count as added in depth-first order
+	for i, n := range nodes {
+		n.seq = uint64(i)
+		if len(n.children) == 0 {
+			bt.leaves[n.hash] = n
+		}
+	}
+	bt.nextSeq = uint64(len(nodes))
+
+	return bt, nil
+}
+
+func putUint32(buf *bytes.Buffer, v uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	buf.Write(b)
+}
+
+func putUint64(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	buf.Write(b)
+}
+
+func putBigInt(buf *bytes.Buffer, v *big.Int) error {
+	if v == nil {
+		buf.WriteByte(0)
+		return nil
+	}
+	if v.Sign() < 0 {
+		return fmt.Errorf("cannot encode negative integer %s", v)
+	}
+	buf.WriteByte(1)
+	b := v.Bytes()
+	putUint32(buf, uint32(len(b)))
+	buf.Write(b)
+	return nil
+}
+
+// decoder consumes an encoded BlockTree, failing on truncated input
+type decoder struct {
+	in []byte
+}
+
+func (d *decoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.in)) < n {
+		return nil, fmt.Errorf("need %d bytes, got %d: %w", n, len(d.in), ErrInvalidEncoding)
+	}
+	b := d.in[:n]
+	d.in = d.in[n:]
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (d *decoder) bigInt() (*big.Int, error) {
+	present, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch present[0] {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("invalid integer flag %d: %w", present[0], ErrInvalidEncoding)
+	}
+
+	length, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.next(uint64(length))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
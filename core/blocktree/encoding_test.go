@@ -0,0 +1,180 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package blocktree
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ChainSafe/gossamer/common"
+	"github.com/ChainSafe/gossamer/core/types"
+)
+
+func createForkedTree(t *testing.T) *BlockTree {
+	bt := createFlatTree(t, 3)
+
+	extraBlocks := []types.Block{
+		{Header: types.BlockHeader{ParentHash: zeroHash, Number: big.NewInt(1), Hash: common.Hash{0xAB}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0x01}, Number: big.NewInt(2), Hash: common.Hash{0xCD}}},
+		{Header: types.BlockHeader{ParentHash: common.Hash{0xCD}, Number: nil, Hash: common.Hash{0xEF}}},
+	}
+	for _, block := range extraBlocks {
+		err := bt.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.GetNode(common.Hash{0xCD}).arrivalTime = 1234
+	bt.GetNode(common.Hash{0xAB}).author = AuthorityID{0xA1}
+	return bt
+}
+
+// compareNodes recursively checks that the subtrees rooted at a and b are equal
+func compareNodes(t *testing.T, a, b *node) {
+	if a.hash != b.hash || a.arrivalTime != b.arrivalTime || a.author != b.author || a.depth.Cmp(b.depth) != 0 {
+		t.Errorf("Fail: got %s expected %s", b, a)
+	}
+	if !reflect.DeepEqual(a.number, b.number) {
+		t.Errorf("Fail: block 0x%X got number %v expected %v", a.hash, b.number, a.number)
+	}
+	if len(a.children) != len(b.children) {
+		t.Fatalf("Fail: block 0x%X got %d children expected %d", a.hash, len(b.children), len(a.children))
+	}
+	for i := range a.children {
+		if b.children[i].parent != b {
+			t.Errorf("Fail: child 0x%X of 0x%X has wrong parent", b.children[i].hash, b.hash)
+		}
+		compareNodes(t, a.children[i], b.children[i])
+	}
+}
+
+func TestBlockTree_EncodeDecode(t *testing.T) {
+	bt := createForkedTree(t)
+
+	enc, err := bt.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Decode(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.head.parent != nil {
+		t.Errorf("expected decoded root to have no parent")
+	}
+	compareNodes(t, bt.head, res.head)
+
+	if len(res.leaves) != len(bt.leaves) {
+		t.Fatalf("Fail: got %d leaves expected %d", len(res.leaves), len(bt.leaves))
+	}
+	for h := range bt.leaves {
+		if res.leaves[h] != res.GetNode(h) {
+			t.Errorf("expected 0x%X to be a leaf of the decoded tree", h)
+		}
+	}
+	if res.DeepestLeaf().hash != bt.DeepestLeaf().hash {
+		t.Errorf("Fail: got deepest leaf %s expected %s", res.DeepestLeaf(), bt.DeepestLeaf())
+	}
+	info, err := res.GetBlockInfo(common.Hash{0xAB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Author != (AuthorityID{0xA1}) {
+		t.Errorf("Fail: got author %x expected %x", info.Author, AuthorityID{0xA1})
+	}
+	if found := res.FindByAuthor(AuthorityID{0xA1}); !reflect.DeepEqual(found, []common.Hash{{0xAB}}) {
+		t.Errorf("Fail: got %v expected [0xAB]", found)
+	}
+
+	// re-encoding is stable
+	reenc, err := res.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enc, reenc) {
+		t.Errorf("Fail: re-encoding differs from the original encoding")
+	}
+}
+
+func TestBlockTree_EncodeDecode_Finalized(t *testing.T) {
+	bt := createForkedTree(t)
+
+	err := bt.Finalize(common.Hash{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := bt.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Decode(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// depths are kept relative to genesis
+	compareNodes(t, bt.head, res.head)
+}
+
+func TestBlockTree_DecodeInvalid(t *testing.T) {
+	enc, err := createForkedTree(t).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every truncation of a valid encoding must fail
+	for i := 0; i < len(enc); i++ {
+		_, err = Decode(enc[:i])
+		if !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("Fail: truncated to %d bytes got %v expected %v", i, err, ErrInvalidEncoding)
+		}
+	}
+
+	corrupted := map[string][]byte{
+		"trailing bytes":  append(append([]byte{}, enc...), 0),
+		"unknown version": append([]byte{encodingVersion + 1}, enc[1:]...),
+		"huge count":      append([]byte{encodingVersion, 0xff, 0xff, 0xff, 0xff}, enc[5:]...),
+		"zero count":      append([]byte{encodingVersion, 0, 0, 0, 0}, enc[5:]...),
+	}
+
+	// version, count and root depth 0, followed by the genesis node with number 0
+	rootStart := 1 + 4 + 5
+	nodeLength := common.HashLength + 4 + 5 + 8 + authorLength
+
+	// point the root at a parent
+	rootParent := append([]byte{}, enc...)
+	copy(rootParent[rootStart+common.HashLength:], []byte{0, 0, 0, 0})
+	corrupted["root with parent"] = rootParent
+
+	// point the second node at itself
+	selfParent := append([]byte{}, enc...)
+	copy(selfParent[rootStart+nodeLength+common.HashLength:], []byte{1, 0, 0, 0})
+	corrupted["self parent"] = selfParent
+
+	for name, in := range corrupted {
+		_, err = Decode(in)
+		if !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("Fail: %s got %v expected %v", name, err, ErrInvalidEncoding)
+		}
+	}
+}
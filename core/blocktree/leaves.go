@@ -17,6 +17,7 @@
 package blocktree
 
 import (
+	"bytes"
 	"math/big"
 
 	"github.com/ChainSafe/gossamer/common"
@@ -31,16 +32,36 @@ func (ls leafMap) Replace(old, new *node) {
 	ls[new.hash] = new
 }
 
+// Tiebreak selects the deepest leaf among leaves of equal depth
+type Tiebreak int
+
+const (
+	// TiebreakByHash selects the leaf with the lowest hash. It's the default, as every node makes the same choice.
+	TiebreakByHash Tiebreak = iota
+	// TiebreakByArrivalTime selects the leaf that arrived first, falling back to the lowest hash on equal arrival times
+	TiebreakByArrivalTime
+)
+
 // DeepestLeaf searches the stored leaves to the find the one with the greatest depth.
-// TODO: Select left-most
-func (ls leafMap) DeepestLeaf() *node {
+// Leaves of equal depth are ordered by the tiebreak, and by their hash bytes after that,
+// so the choice doesn't depend on map iteration order.
+func (ls leafMap) DeepestLeaf(tiebreak Tiebreak) *node {
 	max := big.NewInt(-1)
 	var dLeaf *node
 	for _, n := range ls {
-		if max.Cmp(n.depth) < 0 {
+		cmp := max.Cmp(n.depth)
+		if cmp < 0 || (cmp == 0 && n.precedes(dLeaf, tiebreak)) {
 			max = n.depth
 			dLeaf = n
 		}
 	}
 	return dLeaf
 }
+
+// precedes reports whether n is selected over the other leaf of equal depth
+func (n *node) precedes(other *node, tiebreak Tiebreak) bool {
+	if tiebreak == TiebreakByArrivalTime && n.arrivalTime != other.arrivalTime {
+		return n.arrivalTime < other.arrivalTime
+	}
+	return bytes.Compare(n.hash[:], other.hash[:]) < 0
+}
@@ -26,11 +26,14 @@ import (
 
 // node is an element in the BlockTree
 type node struct {
-	hash     common.Hash // Block hash
-	parent   *node       // Parent node
-	number   *big.Int    // Block number
-	children []*node     // Nodes of children blocks
-	depth    *big.Int    // Depth within the tree
+	hash        common.Hash // Block hash
+	parent      *node       // Parent node
+	number      *big.Int    // Block number
+	children    []*node     // Nodes of children blocks
+	depth       *big.Int    // Depth within the tree
+	arrivalTime uint64      // Arrival time of the block, in milliseconds since the Unix epoch
+	author      AuthorityID // Authority that authored the block, zero if unknown
+	seq         uint64      // Position in the order blocks were added to the tree
 }
 
 // addChild appends node to n's list of children
@@ -38,13 +41,54 @@ func (n *node) addChild(node *node) {
 	n.children = append(n.children, node)
 }
 
+// clone recursively copies n and its descendants under parent, recording every copy in copies by original node
+func (n *node) clone(parent *node, copies map[*node]*node) *node {
+	c := &node{
+		hash:        n.hash,
+		parent:      parent,
+		children:    make([]*node, 0, len(n.children)),
+		depth:       new(big.Int).Set(n.depth),
+		arrivalTime: n.arrivalTime,
+		author:      n.author,
+		seq:         n.seq,
+	}
+	if n.number != nil {
+		c.number = new(big.Int).Set(n.number)
+	}
+	copies[n] = c
+	for _, child := range n.children {
+		c.addChild(child.clone(c, copies))
+	}
+	return c
+}
+
+// info returns a copy of the data of n
+func (n *node) info() BlockInfo {
+	info := BlockInfo{
+		Hash:        n.hash,
+		ArrivalTime: n.arrivalTime,
+		Author:      n.author,
+		Children:    make([]common.Hash, len(n.children)),
+	}
+	if n.parent != nil {
+		info.ParentHash = n.parent.hash
+	}
+	if n.number != nil {
+		info.Number = new(big.Int).Set(n.number)
+	}
+	for i, child := range n.children {
+		info.Children[i] = child.hash
+	}
+	return info
+}
+
 // String returns stringified hash and depth of node
 func (n *node) String() string {
 	return fmt.Sprintf("{h: %s, d: %s}", n.hash.String(), n.depth)
 }
 
 // createTree adds all the nodes children to the existing printable tree.
-// Note: this is strictly for BlockTree.String()
+// Note: this is strictly for BlockTree.Tree()
 func (n *node) createTree(tree gotree.Tree) {
 	for _, child := range n.children {
 		sub := tree.Add(child.String())
@@ -68,25 +112,52 @@ func (n *node) getNode(h common.Hash) *node {
 	return nil
 }
 
-// TODO: This would improved by using parent in node struct and searching child -> parent
+// count returns the number of nodes in n's subtree, n included
+func (n *node) count() int {
+	c := 1
+	for _, child := range n.children {
+		c += child.count()
+	}
+	return c
+}
+
+// getNodesWithNumber appends all the nodes in n's subtree with the given block number to nodes
+func (n *node) getNodesWithNumber(number *big.Int, nodes []*node) []*node {
+	if n.number != nil && n.number.Cmp(number) == 0 {
+		nodes = append(nodes, n)
+	}
+	for _, child := range n.children {
+		nodes = child.getNodesWithNumber(number, nodes)
+	}
+	return nodes
+}
+
 // TODO: verify that parent and child exist in the DB
-// isDescendantOf traverses the tree following all possible paths until it determines if n is a descendant of parent
+// isDescendantOf follows the parent links from n up to the root to determine if n is a descendant of parent.
+// A node is considered a descendant of itself.
 func (n *node) isDescendantOf(parent *node) bool {
 	if parent == nil {
 		return false
 	}
 
-	// NOTE: here we assume the nodes exists in tree
-	if n.hash == parent.hash {
-		return true
-	} else if len(parent.children) == 0 {
-		return false
-	} else {
-		for _, child := range parent.children {
-			if n.isDescendantOf(child) {
-				return true
-			}
+	for curr := n; curr != nil; curr = curr.parent {
+		if curr.hash == parent.hash {
+			return true
 		}
 	}
 	return false
 }
+
+// commonAncestor returns the deepest node that both n and other descend from
+func (n *node) commonAncestor(other *node) *node {
+	ancestors := make(map[*node]bool)
+	for curr := n; curr != nil; curr = curr.parent {
+		ancestors[curr] = true
+	}
+	for curr := other; curr != nil; curr = curr.parent {
+		if ancestors[curr] {
+			return curr
+		}
+	}
+	return nil
+}
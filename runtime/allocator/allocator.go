@@ -19,7 +19,10 @@ package runtime
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"math/bits"
+	"sync"
 
 	log "github.com/ChainSafe/log15"
 	wasm "github.com/wasmerio/go-ext-wasm/wasmer"
@@ -28,18 +31,151 @@ import (
 // This module implements a freeing-bump allocator
 // see more details at https://github.com/paritytech/substrate/issues/1615
 
-// The pointers need to be aligned to 8 bytes
-const alignment uint32 = 8
+// The pointers need to be aligned to at least 8 bytes, this is the default alignment
+const defaultAlignment uint32 = 8
 const HeadsQty = 22
 const MaxPossibleAllocation = 16777216 // 2^24 bytes
 
+// size of a wasm memory page, the unit the heap grows by
+const pageSize = 65536
+
+// markers filling the header after the list index of a live block, or after the free list
+//  link and list index of a freed block, so that a double free can be detected
+//
+// live:  | list index | 255 255 255 255 255 255 255 |
+// freed: | link (4 bytes LE) | list index | 254 254 254 |
+//
+// with an alignment above 8 the header is padded in front, so it always ends right before the payload
+const liveMarker uint8 = 255
+const freedMarker uint8 = 254
+
+// freeListEnd is the link of the last block on a free list, and the head of an empty list. It can't be 0,
+//  since the header of the first block sits at heap offset 0
+const freeListEnd uint32 = math.MaxUint32
+
+var (
+	// ErrSizeTooLarge is returned when an allocation is larger than MaxPossibleAllocation or the largest size class
+	ErrSizeTooLarge = errors.New("size too large")
+	// ErrOutOfSpace is returned when the heap doesn't have room left for an allocation
+	ErrOutOfSpace = errors.New("allocator out of space")
+	// ErrInvalidPointer is returned when deallocating a pointer that wasn't handed out by the allocator
+	ErrInvalidPointer = errors.New("invalid pointer for deallocation")
+	// ErrDoubleFree is returned when deallocating a pointer that has already been freed
+	ErrDoubleFree = errors.New("pointer has already been freed")
+	// ErrAccountingUnderflow is returned when freeing a block would take TotalSize below 0, as it's
+	//   no longer in line with the allocated blocks
+	ErrAccountingUnderflow = errors.New("allocator total size underflow")
+)
+
+// FreeingBumpHeapAllocator is safe for concurrent use, a single value can be
+// shared between goroutines calling into the same runtime instance.
 type FreeingBumpHeapAllocator struct {
+	lock        sync.Mutex
 	bumper      uint32
-	heads       [HeadsQty]uint32
+	heads       []uint32 // one free list per size class
 	heap        *wasm.Memory
 	maxHeapSize uint32
 	ptrOffset   uint32
 	TotalSize   uint32
+	alignment   uint32 // also the size of each block header, padded in front of the 8 meaningful bytes
+	growable    bool
+	growMemory  func(pages uint32) error
+	memLength   uint32 // length of the heap memory when it was bound or last grown by the allocator
+	zeroOnAlloc bool
+	scrubOnFree bool
+	// blocks above MaxPossibleAllocation, by heap offset
+	largeObjects     map[uint32]uint32   // live, to their size
+	freeLargeObjects map[uint32][]uint32 // freed, grouped by size
+	pagePadding      map[uint32]uint32   // padding in front of page aligned ones, live or freed
+	trackLeaks       bool
+	leaks            map[uint32]LeakRecord // live allocations by pointer, when tracking leaks
+	trackHistogram   bool
+	histogram        []uint64 // cumulative allocations by list index, when tracking the histogram
+	maxTotalSize     uint32   // highest TotalSize reached, kept by Reset and FreeAll
+	sideMetadata     bool
+	metadata         map[uint32]blockMetadata // small blocks by heap offset, in side metadata mode
+	freeBlocks       [][]uint32               // freed small blocks of each list, in side metadata mode
+	arenaMode        bool
+	logger           log.Logger
+	guardSize        uint32
+	guards           map[uint32]uint32 // requested size of live allocations by pointer, when guarding them
+	onAllocate       func(ptr, size uint32)
+	onDeallocate     func(ptr, size uint32)
+	maxSmallSize     uint32 // item size of the largest size class in use
+	callActive       bool
+	callBudget       uint32 // bytes the active call may allocate
+	callAllocated    uint64 // bytes allocated by the active call so far
+	highWaterPercent uint32
+	lowWaterPercent  uint32
+	aboveHighWater   bool // whether OnHighWater was called since TotalSize last dropped below the low water mark
+	onHighWater      func(total, max uint32)
+	onLowWater       func(total, max uint32)
+}
+
+// AllocatorConfig holds the optional settings of a FreeingBumpHeapAllocator, the zero value
+//   gives a fixed size heap
+type AllocatorConfig struct {
+	// Growable lets Allocate grow the wasm memory when the heap runs out of space
+	Growable bool
+	// ZeroOnAlloc makes Allocate zero the payload of a block before returning it
+	ZeroOnAlloc bool
+	// ScrubOnFree makes Deallocate zero the payload of a block, so no stale data survives in freed memory. The
+	//   header, which holds the free list link, is kept
+	ScrubOnFree bool
+	// Alignment of the returned pointers, a power of two up to the page size. 0 means the default of
+	//   8 bytes, smaller alignments are raised to 8
+	Alignment uint32
+	// TrackLeaks records the call stack of every live allocation, reported by Leaks. Capturing
+	//   the stacks is expensive, so it's meant for debugging only
+	TrackLeaks bool
+	// TrackHistogram counts the allocations of each size class, reported by AllocationHistogram
+	TrackHistogram bool
+	// SideMetadata keeps the list index and free list link of small blocks outside of the heap instead
+	//   of in a header in front of each block, so every block is fully usable by its payload
+	SideMetadata bool
+	// ArenaMode makes Allocate always bump and Deallocate a no-op, memory is only reclaimed by FreeAll
+	//   or Reset. It suits short-lived arenas of many small allocations that are all freed at once.
+	ArenaMode bool
+	// Logger is used for the allocator's internal logging, e.g. tagged with a runtime instance ID.
+	//   nil means the root log15 logger
+	Logger log.Logger
+	// GuardSize adds that many guard bytes after the requested size of every allocation but the page
+	//   aligned ones, checked when deallocating to detect overruns. It's meant for debugging, 0 means no
+	//   guard bytes
+	GuardSize uint32
+	// OnAllocate is called with the pointer and bucket size of every block allocated, after the lock is
+	//   released. nil means no hook
+	OnAllocate func(ptr, size uint32)
+	// OnDeallocate is called with the pointer and bucket size of every block deallocated, after the lock
+	//   is released. nil means no hook
+	OnDeallocate func(ptr, size uint32)
+	// SizeClasses is the number of power of two size classes of small blocks, from 8 bytes up to at most
+	//   HeadsQty classes of MaxPossibleAllocation. Fewer classes lower the largest small allocation to
+	//   8 << (SizeClasses-1) bytes, larger ones up to MaxPossibleAllocation are rejected while those above
+	//   still take the large-object path. There is one free list per class, as well as one entry in
+	//   AllocatorStats.FreeBlocks and AllocationHistogram. 0 means HeadsQty
+	SizeClasses int
+	// OnHighWater is called with TotalSize and the maximum heap size when TotalSize reaches HighWaterPercent
+	//   of the maximum heap size, after the lock is released, e.g. to throttle incoming work. It's called
+	//   again only after TotalSize dropped below LowWaterPercent. nil means no callback
+	OnHighWater func(total, max uint32)
+	// OnLowWater is called like OnHighWater when TotalSize drops below LowWaterPercent of the maximum heap
+	//   size after having reached the high water mark. nil means no callback
+	OnLowWater func(total, max uint32)
+	// HighWaterPercent is the threshold of OnHighWater, in percent of the maximum heap size up to 100.
+	//   0 means 90
+	HighWaterPercent uint32
+	// LowWaterPercent is the threshold of OnLowWater, in percent of the maximum heap size below
+	//   HighWaterPercent. 0 means 10 below HighWaterPercent, or half of it for marks up to 10
+	LowWaterPercent uint32
+}
+
+// AllocatorStats is a point-in-time view of the allocator's metrics
+type AllocatorStats struct {
+	TotalSize   uint32
+	Bumper      uint32
+	MaxHeapSize uint32
+	FreeBlocks  []uint32 // number of entries in each free list, one per size class
 }
 
 // Creates a new allocation heap which follows a freeing-bump strategy.
@@ -54,97 +190,868 @@ type FreeingBumpHeapAllocator struct {
 //   offset on. The pointer offset needs to be aligned to a multiple of 8,
 //   hence a padding might be added to align `ptrOffset` properly.
 //
-// * returns a pointer to an initilized FreeingBumpHeapAllocator
-func NewAllocator(mem *wasm.Memory, ptrOffset uint32) *FreeingBumpHeapAllocator {
+// * returns a pointer to an initilized FreeingBumpHeapAllocator, or an error if the aligned
+//   `ptrOffset` leaves no memory for the heap
+func NewAllocator(mem *wasm.Memory, ptrOffset uint32) (*FreeingBumpHeapAllocator, error) {
+	return NewAllocatorWithConfig(mem, ptrOffset, AllocatorConfig{})
+}
+
+// NewAllocatorWithConfig creates a new allocation heap like NewAllocator, with the optional
+//   behaviour set in cfg
+func NewAllocatorWithConfig(mem *wasm.Memory, ptrOffset uint32, cfg AllocatorConfig) (*FreeingBumpHeapAllocator, error) {
 	fbha := new(FreeingBumpHeapAllocator)
 	currentSize := mem.Length()
-	// we don't include offset memory in the heap
-	heapSize := currentSize - ptrOffset
+
+	alignment := cfg.Alignment
+	if alignment&(alignment-1) != 0 || alignment > pageSize {
+		return nil, fmt.Errorf("alignment %d is not a power of two up to %d", alignment, pageSize)
+	}
+	if alignment < defaultAlignment {
+		alignment = defaultAlignment
+	}
+
+	sizeClasses := cfg.SizeClasses
+	if sizeClasses == 0 {
+		sizeClasses = HeadsQty
+	}
+	// with HeadsQty classes the largest one is MaxPossibleAllocation
+	if sizeClasses < 0 || sizeClasses > HeadsQty {
+		return nil, fmt.Errorf("%d size classes is not between 1 and %d", sizeClasses, HeadsQty)
+	}
+	// blocks are rounded up to the alignment, so it has to fit the largest class
+	maxSmallSize := uint32(getItemSizeFromIndex(uint(sizeClasses - 1)))
+	if maxSmallSize < alignment {
+		return nil, fmt.Errorf("%d size classes up to %d bytes don't fit the alignment %d", sizeClasses, maxSmallSize, alignment)
+	}
+
+	highWater := cfg.HighWaterPercent
+	if highWater == 0 {
+		highWater = defaultHighWaterPercent
+	}
+	lowWater := cfg.LowWaterPercent
+	if lowWater == 0 {
+		lowWater = highWater / 2
+		if highWater > defaultLowWaterGap {
+			lowWater = highWater - defaultLowWaterGap
+		}
+	}
+	if highWater > 100 || lowWater >= highWater {
+		return nil, fmt.Errorf("low water mark %d%% is not below high water mark %d%% of at most 100%%", lowWater, highWater)
+	}
 
 	padding := ptrOffset % alignment
 	if padding != 0 {
 		ptrOffset += alignment - padding
 	}
+	// without headers the first block starts at heap offset 0, which mustn't be handed out as a null pointer
+	if cfg.SideMetadata && ptrOffset == 0 {
+		ptrOffset = alignment
+	}
+	if ptrOffset >= currentSize {
+		return nil, fmt.Errorf("pointer offset %d leaves no heap in %d bytes of memory", ptrOffset, currentSize)
+	}
+	// we don't include offset memory in the heap
+	heapSize := currentSize - ptrOffset
 
 	fbha.bumper = 0
+	fbha.heads = emptyHeads(sizeClasses)
+	fbha.histogram = make([]uint64, sizeClasses)
+	fbha.freeBlocks = make([][]uint32, sizeClasses)
 	fbha.heap = mem
 	fbha.maxHeapSize = heapSize
 	fbha.ptrOffset = ptrOffset
 	fbha.TotalSize = 0
+	fbha.alignment = alignment
+	fbha.growable = cfg.Growable
+	fbha.growMemory = mem.Grow
+	fbha.memLength = currentSize
+	fbha.zeroOnAlloc = cfg.ZeroOnAlloc
+	fbha.scrubOnFree = cfg.ScrubOnFree
+	fbha.largeObjects = make(map[uint32]uint32)
+	fbha.freeLargeObjects = make(map[uint32][]uint32)
+	fbha.pagePadding = make(map[uint32]uint32)
+	fbha.trackLeaks = cfg.TrackLeaks
+	fbha.trackHistogram = cfg.TrackHistogram
+	fbha.leaks = make(map[uint32]LeakRecord)
+	fbha.sideMetadata = cfg.SideMetadata
+	fbha.metadata = make(map[uint32]blockMetadata)
+	fbha.arenaMode = cfg.ArenaMode
+	fbha.logger = cfg.Logger
+	if fbha.logger == nil {
+		fbha.logger = log.Root()
+	}
+	fbha.guardSize = cfg.GuardSize
+	fbha.guards = make(map[uint32]uint32)
+	fbha.onAllocate = cfg.OnAllocate
+	fbha.onDeallocate = cfg.OnDeallocate
+	fbha.maxSmallSize = maxSmallSize
+	fbha.highWaterPercent = highWater
+	fbha.lowWaterPercent = lowWater
+	fbha.onHighWater = cfg.OnHighWater
+	fbha.onLowWater = cfg.OnLowWater
 
-	return fbha
+	return fbha, nil
 }
 
 // Allocate determines if there is space available in WASM heap to grow the heap by 'size'.  If there is space
 //   available it grows the heap to fit give 'size'.  The heap grows is chunks of Powers of 2, so the growth becomes
-//   the next highest power of 2 of the requested size.
-func (fbha *FreeingBumpHeapAllocator) Allocate(size uint32) (uint32, error) {
-	// test for space allocation
-	if size > MaxPossibleAllocation {
-		err := errors.New("size to large")
-		return 0, err
+//   the next highest power of 2 of the requested size. Sizes above MaxPossibleAllocation are served by the
+//   large-object path instead.
+func (fbha *FreeingBumpHeapAllocator) Allocate(size uint32) (ptr uint32, err error) {
+	fbha.lock.Lock()
+	var bucket uint32
+	// the hook is called without the lock, so it can call back into the allocator
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		if err == nil && fbha.onAllocate != nil {
+			fbha.onAllocate(ptr, bucket)
+		}
+		notify()
+	}()
+
+	ptr, err = fbha.allocate(size)
+	if err == nil && fbha.onAllocate != nil {
+		bucket = fbha.hookSize(ptr)
 	}
-	itemSize := nextPowerOf2GT8(size)
+	return ptr, err
+}
+
+// AllocateSized allocates like Allocate and also returns the capacity of the block, the number of
+//   bytes usable at ptr. The capacity is the requested size rounded up to its power of two bucket (or
+//   to whole pages for large allocations), so it can be larger than size.
+func (fbha *FreeingBumpHeapAllocator) AllocateSized(size uint32) (ptr uint32, capacity uint32, err error) {
+	fbha.lock.Lock()
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		if err == nil && fbha.onAllocate != nil {
+			fbha.onAllocate(ptr, capacity+fbha.guardSize)
+		}
+		notify()
+	}()
+
+	ptr, err = fbha.allocate(size)
+	if err != nil {
+		return 0, 0, err
+	}
+	capacity, err = fbha.payloadSize(ptr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ptr, capacity - fbha.guardSize, nil
+}
+
+// AllocateSlice allocates like Allocate and also returns a slice aliasing the size bytes of the payload in
+//   the heap memory, so the caller can copy into it directly. The slice's capacity is capped at size, so
+//   appending to it doesn't write past the allocation. It's only valid until the memory is grown or the
+//   allocator is relocated, as the memory's data may then be moved.
+func (fbha *FreeingBumpHeapAllocator) AllocateSlice(size uint32) (ptr uint32, buf []byte, err error) {
+	fbha.lock.Lock()
+	var bucket uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		if err == nil && fbha.onAllocate != nil {
+			fbha.onAllocate(ptr, bucket)
+		}
+		notify()
+	}()
+
+	ptr, err = fbha.allocate(size)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fbha.onAllocate != nil {
+		bucket = fbha.hookSize(ptr)
+	}
+	// the heap may have grown, so the data slice is fetched after allocating
+	return ptr, fbha.heap.Data()[ptr : ptr+size : ptr+size], nil
+}
+
+// AllocateBatch allocates a block for each of the sizes while holding the lock once, returning the
+//   pointers in the same order as sizes. If any allocation fails, the blocks already allocated for the
+//   batch are deallocated before returning the error. In arena mode, where deallocating does nothing,
+//   the bumper, TotalSize, peak usage and histogram are put back to where they were before the batch.
+func (fbha *FreeingBumpHeapAllocator) AllocateBatch(sizes []uint32) (ptrs []uint32, err error) {
+	fbha.lock.Lock()
+	var buckets []uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		// a rolled back batch isn't reported at all
+		if err == nil && fbha.onAllocate != nil {
+			for i, ptr := range ptrs {
+				fbha.onAllocate(ptr, buckets[i])
+			}
+		}
+		notify()
+	}()
+
+	// deallocate does nothing in arena mode, so a failed batch is rolled back by undoing the bump
+	var bumper, totalSize, peak uint32
+	var histogram []uint64
+	if fbha.arenaMode {
+		bumper, totalSize, peak = fbha.bumper, fbha.TotalSize, fbha.maxTotalSize
+		if fbha.trackHistogram {
+			histogram = append([]uint64(nil), fbha.histogram...)
+		}
+	}
+
+	ptrs = make([]uint32, 0, len(sizes))
+	for i, size := range sizes {
+		ptr, err := fbha.allocate(size)
+		if err != nil {
+			// roll back in reverse so the free lists are in the order they would be after individual calls
+			for j := len(ptrs) - 1; j >= 0; j-- {
+				if fbha.arenaMode {
+					fbha.discardArenaBlock(ptrs[j])
+				} else if rbErr := fbha.deallocate(ptrs[j]); rbErr != nil {
+					fbha.logger.Error("[AllocateBatch]", "cannot roll back pointer", ptrs[j], "error", rbErr)
+				}
+				// the batch never got the blocks, so they don't count against the call's budget
+				fbha.refundCall(sizes[j])
+			}
+			if fbha.arenaMode {
+				fbha.bumper, fbha.TotalSize, fbha.maxTotalSize = bumper, totalSize, peak
+				if histogram != nil {
+					fbha.histogram = histogram
+				}
+			}
+			return nil, fmt.Errorf("batch allocation %d: %w", i, err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	if fbha.onAllocate != nil {
+		buckets = make([]uint32, len(ptrs))
+		for i, ptr := range ptrs {
+			buckets[i] = fbha.hookSize(ptr)
+		}
+	}
+
+	return ptrs, nil
+}
+
+// discardArenaBlock drops the bookkeeping of a block allocated in arena mode, whose space is given back
+//   by moving the bumper back
+func (fbha *FreeingBumpHeapAllocator) discardArenaBlock(pointer uint32) {
+	ptr := pointer - fbha.ptrOffset
+	delete(fbha.leaks, pointer)
+	delete(fbha.guards, pointer)
+	delete(fbha.largeObjects, ptr)
+	delete(fbha.pagePadding, ptr)
+	delete(fbha.metadata, ptr)
+}
 
-	if (itemSize + 8 + fbha.TotalSize) > fbha.maxHeapSize {
-		err := errors.New("allocator out of space")
+func (fbha *FreeingBumpHeapAllocator) allocate(size uint32) (uint32, error) {
+	if err := fbha.checkCallBudget(size); err != nil {
 		return 0, err
 	}
 
+	blockSize := size + fbha.guardSize
+	if blockSize < size {
+		return 0, fmt.Errorf("cannot allocate %d bytes with guard: %w", size, ErrSizeTooLarge)
+	}
+
+	var ptr uint32
+	var err error
+	if blockSize > MaxPossibleAllocation {
+		ptr, err = fbha.allocateLarge(blockSize)
+	} else if blockSize > fbha.maxSmallSize {
+		err = fmt.Errorf("cannot allocate %d bytes above the largest size class of %d: %w", blockSize, fbha.maxSmallSize, ErrSizeTooLarge)
+	} else {
+		ptr, err = fbha.allocateSmall(blockSize)
+	}
+	if err == nil && fbha.guardSize > 0 {
+		fbha.setGuard(ptr, size)
+	}
+	if err == nil && fbha.trackLeaks {
+		fbha.recordAllocation(ptr, size)
+	}
+	if err == nil {
+		fbha.chargeCall(size)
+	}
+	fbha.updatePeak()
+	return ptr, err
+}
+
+// updatePeak raises the peak usage to TotalSize after an allocation
+func (fbha *FreeingBumpHeapAllocator) updatePeak() {
+	if fbha.TotalSize > fbha.maxTotalSize {
+		fbha.maxTotalSize = fbha.TotalSize
+	}
+}
+
+func (fbha *FreeingBumpHeapAllocator) allocateSmall(size uint32) (uint32, error) {
+	itemSize := fbha.itemSize(size)
+	// the bucket size is clamped to MaxPossibleAllocation, so it can't hold a larger request
+	if itemSize < size {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, ErrSizeTooLarge)
+	}
+
+	err := fbha.ensureSpace(itemSize + fbha.headerSize())
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+
 	// get pointer based on list_index
 	listIndex := bits.TrailingZeros32(itemSize) - 3
 
 	var ptr uint32
-	if fbha.heads[listIndex] != 0 {
-		// Something from the free list
-		item := fbha.heads[listIndex]
-		fourBytes := fbha.getHeap4bytes(item)
-		fbha.heads[listIndex] = binary.LittleEndian.Uint32(fourBytes)
-		ptr = item + 8
+	if fbha.sideMetadata {
+		ptr, err = fbha.allocateSide(listIndex, itemSize)
+		if err != nil {
+			return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+		}
 	} else {
-		// Nothing te be freed. Bump.
-		ptr = fbha.bump(itemSize+8) + 8
-	}
+		if !fbha.arenaMode && fbha.heads[listIndex] != freeListEnd {
+			// Something from the free list
+			item := fbha.heads[listIndex]
+			fourBytes := fbha.getHeap4bytes(item)
+			fbha.heads[listIndex] = binary.LittleEndian.Uint32(fourBytes)
+			ptr = item + 8
+		} else {
+			// Nothing te be freed. Bump.
+			ptr, err = fbha.bump(itemSize + fbha.alignment)
+			if err != nil {
+				return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+			}
+			ptr += fbha.alignment
+		}
 
-	// write "header" for allocated memory to heap
-	for i := uint32(1); i <= 8; i++ {
-		fbha.setHeap(ptr-i, 255)
+		fbha.setLiveHeader(ptr, uint8(listIndex))
+	}
+	if fbha.zeroOnAlloc {
+		fbha.zero(ptr, itemSize)
+	}
+	if fbha.trackHistogram {
+		fbha.histogram[listIndex]++
 	}
-	fbha.setHeap(ptr-8, uint8(listIndex))
-	fbha.TotalSize = fbha.TotalSize + itemSize + 8
-	log.Debug("[Allocate]", "heap_size after allocation", fbha.TotalSize)
+	fbha.TotalSize = fbha.TotalSize + itemSize + fbha.headerSize()
+	fbha.logger.Debug("[Allocate]", "heap_size after allocation", fbha.TotalSize)
 	return fbha.ptrOffset + ptr, nil
 }
 
-// Deallocate deallocates the memory located at pointer address
-func (fbha *FreeingBumpHeapAllocator) Deallocate(pointer uint32) error {
+// CanAllocate reports whether Allocate(size) would currently succeed, without changing any state. It's
+//   false if the allocation would exceed the budget of an active call, see BeginCall. Like
+//   Allocate it checks the rounded up block size against the space left in the heap, and then that the block
+//   can be taken from its free list or bumped below the end of the heap. A growable allocator reports true
+//   when the heap would have to grow, since growing can only be known to fail by trying.
+func (fbha *FreeingBumpHeapAllocator) CanAllocate(size uint32) bool {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	if fbha.checkCallBudget(size) != nil {
+		return false
+	}
+	blockSize := uint64(size) + uint64(fbha.guardSize)
+	if blockSize > uint64(^uint32(0)) {
+		return false
+	}
+	size = uint32(blockSize)
+
+	var qty uint64
+	var reusable bool
+	if size > MaxPossibleAllocation {
+		regionSize, err := largeRegionSize(size)
+		if err != nil {
+			return false
+		}
+		qty = uint64(regionSize) + uint64(fbha.headerSize())
+		reusable = len(fbha.freeLargeObjects[regionSize]) > 0
+	} else if size > fbha.maxSmallSize {
+		return false
+	} else {
+		itemSize := fbha.itemSize(size)
+		qty = uint64(itemSize) + uint64(fbha.headerSize())
+		listIndex := bits.TrailingZeros32(itemSize) - 3
+		if fbha.sideMetadata {
+			reusable = len(fbha.freeBlocks[listIndex]) > 0
+		} else {
+			reusable = fbha.heads[listIndex] != freeListEnd
+		}
+	}
+	if fbha.growable {
+		return true
+	}
+	if qty+uint64(fbha.TotalSize) > uint64(fbha.maxHeapSize) {
+		return false
+	}
+	// a block that isn't reused is bumped, which has to fit below the end of the heap as well
+	return (reusable && !fbha.arenaMode) || qty+uint64(fbha.bumper) <= uint64(fbha.maxHeapSize)
+}
+
+// itemSize returns the payload size of the block serving a request of size bytes
+func (fbha *FreeingBumpHeapAllocator) itemSize(size uint32) uint32 {
+	itemSize := nextPowerOf2GT8(size)
+	// blocks are a multiple of the alignment, so bumped blocks stay aligned
+	if itemSize < fbha.alignment {
+		itemSize = fbha.alignment
+	}
+	return itemSize
+}
+
+// Deallocate deallocates the memory located at pointer address, in arena mode it does nothing. If the
+//   allocation's guard bytes were overwritten, the block is freed and ErrBufferOverflow is returned.
+func (fbha *FreeingBumpHeapAllocator) Deallocate(pointer uint32) (err error) {
+	fbha.lock.Lock()
+	var bucket uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		fbha.notifyDeallocate(pointer, bucket, err)
+		notify()
+	}()
+
+	if fbha.onDeallocate != nil && !fbha.arenaMode {
+		bucket = fbha.hookSize(pointer)
+	}
+	return fbha.deallocate(pointer)
+}
+
+// DeallocateSized deallocates the memory located at pointer address like Deallocate, and returns the
+//   number of bytes reclaimed, by which TotalSize dropped. That is the size of the block's bucket plus
+//   its header and any page padding in front of it, not the size that was requested when allocating,
+//   or 0 in arena mode. The size is also returned along with ErrBufferOverflow, since the block is freed.
+func (fbha *FreeingBumpHeapAllocator) DeallocateSized(pointer uint32) (freed uint32, err error) {
+	fbha.lock.Lock()
+	var bucket uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		if freed != 0 {
+			fbha.notifyDeallocate(pointer, bucket, err)
+		}
+		notify()
+	}()
+
+	bucket, err = fbha.payloadSize(pointer)
+	if err != nil {
+		return 0, err
+	}
+	if fbha.arenaMode {
+		return 0, nil
+	}
+	totalSize := fbha.TotalSize
+	err = fbha.deallocate(pointer)
+	if err != nil && !errors.Is(err, ErrBufferOverflow) {
+		return 0, err
+	}
+	return totalSize - fbha.TotalSize, err
+}
+
+func (fbha *FreeingBumpHeapAllocator) deallocate(pointer uint32) error {
+	// in arena mode blocks are only reclaimed all at once by FreeAll
+	if fbha.arenaMode {
+		return nil
+	}
+
+	size, err := fbha.payloadSize(pointer)
+	if err != nil {
+		return err
+	}
+	// checked before anything is freed, so a failed deallocation leaves the block live
+	freed := uint64(size) + uint64(fbha.headerSize())
+	if _, ok := fbha.largeObjects[pointer-fbha.ptrOffset]; ok {
+		freed += uint64(fbha.pagePadding[pointer-fbha.ptrOffset])
+	}
+	if freed > uint64(fbha.TotalSize) {
+		return fmt.Errorf("pointer %d: freeing %d of %d bytes: %w", pointer, freed, fbha.TotalSize, ErrAccountingUnderflow)
+	}
+
+	// an overrun is reported once the block is freed, the block itself is still valid
+	overflow := fbha.checkGuard(pointer)
+	delete(fbha.guards, pointer)
+	err = fbha.deallocateBlock(pointer)
+	if err != nil {
+		return err
+	}
+	return overflow
+}
+
+// deallocateBlock frees the live block at pointer
+func (fbha *FreeingBumpHeapAllocator) deallocateBlock(pointer uint32) error {
+	delete(fbha.leaks, pointer)
+
 	ptr := pointer - fbha.ptrOffset
-	if ptr < 8 {
-		return errors.New("invalid pointer for deallocation")
+	if _, ok := fbha.largeObjects[ptr]; ok {
+		return fbha.deallocateLarge(ptr)
 	}
-	log.Debug("[Deallocate]", "ptr", ptr)
-	listIndex := fbha.getHeapByte(ptr - 8)
+	fbha.logger.Debug("[Deallocate]", "ptr", ptr)
 
-	// update heads array, and heap "header"
-	tail := fbha.heads[listIndex]
-	fbha.heads[listIndex] = ptr - 8
+	var listIndex uint8
+	if fbha.sideMetadata {
+		listIndex = fbha.deallocateSide(ptr)
+	} else {
+		listIndex = fbha.getHeapByte(ptr - 8)
+
+		// update heads array, and heap "header"
+		tail := fbha.heads[listIndex]
+		fbha.heads[listIndex] = ptr - 8
 
-	bTail := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bTail, tail)
-	fbha.setHeap4bytes(ptr-8, bTail)
+		bTail := make([]byte, 4)
+		binary.LittleEndian.PutUint32(bTail, tail)
+		fbha.setHeap4bytes(ptr-8, bTail)
+		fbha.setHeap(ptr-4, listIndex)
+		for i := uint32(1); i <= 3; i++ {
+			fbha.setHeap(ptr-i, freedMarker)
+		}
+	}
 
 	// update heap total size
 	itemSize := getItemSizeFromIndex(uint(listIndex))
-	fbha.TotalSize = fbha.TotalSize - uint32(itemSize+8)
-	log.Debug("[Deallocate]", "heap total_size after Deallocate", fbha.TotalSize)
+	if fbha.scrubOnFree {
+		fbha.zero(ptr, uint32(itemSize))
+	}
+	fbha.TotalSize = fbha.TotalSize - uint32(itemSize) - fbha.headerSize()
+	fbha.logger.Debug("[Deallocate]", "heap total_size after Deallocate", fbha.TotalSize)
+
+	return nil
+}
+
+// Realloc resizes the allocation at ptr to newSize bytes. If newSize still fits the block's bucket
+//   the same pointer is returned, otherwise the payload is moved to a new block, truncated to newSize,
+//   and the old block is freed. On error the old allocation is left untouched.
+func (fbha *FreeingBumpHeapAllocator) Realloc(ptr, newSize uint32) (newPtr uint32, err error) {
+	fbha.lock.Lock()
+	var oldBucket, newBucket uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		// resizing in place isn't reported
+		if err == nil && newPtr != ptr {
+			if fbha.onAllocate != nil {
+				fbha.onAllocate(newPtr, newBucket)
+			}
+			fbha.notifyDeallocate(ptr, oldBucket, nil)
+		}
+		notify()
+	}()
+
+	if fbha.onDeallocate != nil {
+		oldBucket = fbha.hookSize(ptr)
+	}
+	oldSize, err := fbha.payloadSize(ptr)
+	if err != nil {
+		return 0, err
+	}
+	err = fbha.checkGuard(ptr)
+	if err != nil {
+		return 0, err
+	}
+	// with guard bytes, the guard has to fit the block after the payload
+	oldSize -= fbha.guardSize
+	if newSize <= oldSize {
+		if record, ok := fbha.leaks[ptr]; ok {
+			record.Size = newSize
+			fbha.leaks[ptr] = record
+		}
+		if fbha.guardSize > 0 {
+			fbha.setGuard(ptr, newSize)
+		}
+		return ptr, nil
+	}
+
+	newPtr, err = fbha.allocate(newSize)
+	if err != nil {
+		return 0, err
+	}
+	if fbha.onAllocate != nil {
+		newBucket = fbha.hookSize(newPtr)
+	}
+	// only the requested size is copied with guard bytes, so the old guard doesn't overwrite the new payload
+	if size, ok := fbha.guards[ptr]; ok {
+		oldSize = size
+	}
+	// the heap may have grown, so the data slice is fetched after allocating
+	data := fbha.heap.Data()
+	copy(data[newPtr:newPtr+oldSize], data[ptr:ptr+oldSize])
 
+	err = fbha.deallocate(ptr)
+	if err != nil {
+		// the caller keeps the old pointer, so the new block is given back rather than leaked
+		if rbErr := fbha.deallocate(newPtr); rbErr != nil {
+			fbha.logger.Error("[Realloc]", "cannot roll back pointer", newPtr, "error", rbErr)
+		}
+		fbha.refundCall(newSize)
+		return 0, err
+	}
+	return newPtr, nil
+}
+
+// Reset discards every allocation, returning the allocator to the state it had
+//   right after construction. The heap memory, pointer offset and maximum heap size are kept,
+//   so a pooled runtime can reuse its allocator between calls.
+func (fbha *FreeingBumpHeapAllocator) Reset() {
+	fbha.lock.Lock()
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		notify()
+	}()
+
+	fbha.reset()
+	fbha.logger.Debug("[Reset]", "heap total_size after Reset", fbha.TotalSize)
+}
+
+// FreeAll frees every live allocation at once, which is cheaper than deallocating each of them
+//   when a runtime call completes and its working set is discarded. It has the same effect as Reset.
+func (fbha *FreeingBumpHeapAllocator) FreeAll() {
+	fbha.lock.Lock()
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		notify()
+	}()
+
+	fbha.reset()
+	fbha.logger.Debug("[FreeAll]", "heap total_size after FreeAll", fbha.TotalSize)
+}
+
+// Relocate rebinds the allocator to mem, e.g. when the runtime's linear memory was moved, assuming the heap
+//   contents were copied over. The bumper, free lists and TotalSize are kept. A heap that extended to the end
+//   of the old memory extends to the end of mem, while a bounded one, like a sub-heap of NewAllocatorPool,
+//   keeps its maximum size. The old memory's length is the one the allocator last saw, so mem may also be the
+//   old memory after it was grown outside of the allocator. An error is returned if mem is smaller.
+func (fbha *FreeingBumpHeapAllocator) Relocate(mem *wasm.Memory) error {
+	fbha.lock.Lock()
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		notify()
+	}()
+
+	oldSize := fbha.memLength
+	newSize := mem.Length()
+	if newSize < oldSize {
+		return fmt.Errorf("cannot relocate %d bytes of memory to %d bytes", oldSize, newSize)
+	}
+
+	if fbha.ptrOffset+fbha.maxHeapSize == oldSize {
+		fbha.maxHeapSize = newSize - fbha.ptrOffset
+	}
+	fbha.heap = mem
+	fbha.growMemory = mem.Grow
+	fbha.memLength = newSize
+	fbha.logger.Debug("[Relocate]", "max_heap_size after Relocate", fbha.maxHeapSize)
 	return nil
 }
 
-func (fbha *FreeingBumpHeapAllocator) bump(qty uint32) uint32 {
+// emptyHeads returns the heads of n free lists that hold no blocks
+func emptyHeads(n int) []uint32 {
+	heads := make([]uint32, n)
+	for i := range heads {
+		heads[i] = freeListEnd
+	}
+	return heads
+}
+
+func (fbha *FreeingBumpHeapAllocator) reset() {
+	fbha.bumper = 0
+	fbha.heads = emptyHeads(len(fbha.heads))
+	fbha.largeObjects = make(map[uint32]uint32)
+	fbha.freeLargeObjects = make(map[uint32][]uint32)
+	fbha.pagePadding = make(map[uint32]uint32)
+	fbha.leaks = make(map[uint32]LeakRecord)
+	fbha.guards = make(map[uint32]uint32)
+	fbha.metadata = make(map[uint32]blockMetadata)
+	fbha.freeBlocks = make([][]uint32, len(fbha.heads))
+	fbha.TotalSize = 0
+}
+
+// Stats returns the current allocator metrics, the free list entries are counted by walking
+//   each list from its head
+func (fbha *FreeingBumpHeapAllocator) Stats() AllocatorStats {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	stats := AllocatorStats{
+		TotalSize:   fbha.TotalSize,
+		Bumper:      fbha.bumper,
+		MaxHeapSize: fbha.maxHeapSize,
+		FreeBlocks:  make([]uint32, len(fbha.heads)),
+	}
+
+	// a list can't hold more blocks than fit below the bumper (the smallest block is 8 bytes
+	//  plus its 8 byte header), so a longer walk means the heap is corrupted and the list loops
+	maxBlocks := fbha.bumper / 16
+	if fbha.sideMetadata {
+		for i, free := range fbha.freeBlocks {
+			stats.FreeBlocks[i] = uint32(len(free))
+		}
+	}
+	for i, item := range fbha.heads {
+		for item != freeListEnd && stats.FreeBlocks[i] < maxBlocks {
+			stats.FreeBlocks[i]++
+			item = binary.LittleEndian.Uint32(fbha.getHeap4bytes(item))
+		}
+	}
+
+	return stats
+}
+
+// AllocationHistogram returns the number of allocations served by each free list (size class
+//   8 << index), one count per size class, since the allocator was created, including the ones freed since. The counts are kept
+//   by Reset and FreeAll. Allocations above MaxPossibleAllocation have no size class and aren't counted.
+//   Counting only happens if the allocator was created with AllocatorConfig.TrackHistogram.
+func (fbha *FreeingBumpHeapAllocator) AllocationHistogram() []uint64 {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	return append([]uint64(nil), fbha.histogram...)
+}
+
+// PeakUsage returns the highest TotalSize reached since the allocator was created or ResetPeak was last
+//   called. Reset and FreeAll keep it, so it reflects the peak over a whole session.
+func (fbha *FreeingBumpHeapAllocator) PeakUsage() uint32 {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	return fbha.maxTotalSize
+}
+
+// ResetPeak sets the peak usage back to the current TotalSize
+func (fbha *FreeingBumpHeapAllocator) ResetPeak() {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	fbha.maxTotalSize = fbha.TotalSize
+}
+
+// PreferFreeList reports whether the free list at listIndex currently holds free blocks, meaning
+//   an allocation of item size 8 << listIndex would reuse a block rather than bump. This is advisory,
+//   a concurrent allocation can take the block before the caller does. Out of range indices report false.
+func (fbha *FreeingBumpHeapAllocator) PreferFreeList(listIndex int) bool {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	if listIndex < 0 || listIndex >= len(fbha.heads) {
+		return false
+	}
+	if fbha.sideMetadata {
+		return len(fbha.freeBlocks[listIndex]) > 0
+	}
+	return fbha.heads[listIndex] != freeListEnd
+}
+
+// payloadSize checks that pointer is a live allocation and returns the number of bytes usable by it
+func (fbha *FreeingBumpHeapAllocator) payloadSize(pointer uint32) (uint32, error) {
+	ptr := pointer - fbha.ptrOffset
+	if size, ok := fbha.largeObjects[ptr]; ok {
+		return size, nil
+	}
+	if fbha.sideMetadata {
+		return fbha.sidePayloadSize(pointer)
+	}
+
+	inHeap := ptr >= 8 && ptr <= fbha.bumper
+	if inHeap && fbha.isFreed(ptr) {
+		return 0, fmt.Errorf("pointer %d: %w", pointer, ErrDoubleFree)
+	}
+	if !inHeap || !fbha.isLive(ptr) || int(fbha.getHeapByte(ptr-8)) >= len(fbha.heads) {
+		if _, ok := fbha.freedLargeSize(ptr); ok {
+			return 0, fmt.Errorf("pointer %d: %w", pointer, ErrDoubleFree)
+		}
+		return 0, fmt.Errorf("pointer %d was not allocated: %w", pointer, ErrInvalidPointer)
+	}
+
+	return uint32(getItemSizeFromIndex(uint(fbha.getHeapByte(ptr - 8)))), nil
+}
+
+// ensureSpace checks that qty more bytes fit in the heap, if they don't and the allocator is
+//   growable the heap is grown once before giving up
+func (fbha *FreeingBumpHeapAllocator) ensureSpace(qty uint32) error {
+	// summed in 64 bits, so TotalSize can't wrap around once the allocation is added to it
+	required := uint64(qty) + uint64(fbha.TotalSize)
+	if required > uint64(fbha.maxHeapSize) && fbha.growable && required <= uint64(^uint32(0)) {
+		err := fbha.grow(uint32(required) - fbha.maxHeapSize)
+		if err != nil {
+			fbha.logger.Debug("[ensureSpace]", "failed to grow heap", err)
+		}
+	}
+	if required > uint64(fbha.maxHeapSize) {
+		return ErrOutOfSpace
+	}
+	return nil
+}
+
+// grow adds enough wasm pages to the heap memory to fit qty more bytes
+func (fbha *FreeingBumpHeapAllocator) grow(qty uint32) error {
+	pages := (qty + pageSize - 1) / pageSize
+	err := fbha.growMemory(pages)
+	if err != nil {
+		return err
+	}
+	fbha.maxHeapSize += pages * pageSize
+	fbha.memLength = fbha.heap.Length()
+	fbha.logger.Debug("[grow]", "pages", pages, "max_heap_size after grow", fbha.maxHeapSize)
+	return nil
+}
+
+// isLive checks that the header of the block at ptr still holds the live marker, or that its side metadata is live
+func (fbha *FreeingBumpHeapAllocator) isLive(ptr uint32) bool {
+	if fbha.sideMetadata {
+		meta, ok := fbha.metadata[ptr]
+		return ok && !meta.freed
+	}
+	for i := uint32(1); i < 8; i++ {
+		if fbha.getHeapByte(ptr-i) != liveMarker {
+			return false
+		}
+	}
+	return true
+}
+
+// isFreed checks if the header of the block at ptr holds the freed marker, or if its side metadata is freed
+func (fbha *FreeingBumpHeapAllocator) isFreed(ptr uint32) bool {
+	if fbha.sideMetadata {
+		meta, ok := fbha.metadata[ptr]
+		return ok && meta.freed
+	}
+	for i := uint32(1); i <= 3; i++ {
+		if fbha.getHeapByte(ptr-i) != freedMarker {
+			return false
+		}
+	}
+	return true
+}
+
+// bump reserves qty bytes at the bumper and returns their heap offset. TotalSize only counts the live blocks, so
+//   the freed blocks below the bumper can leave too little room to bump even when ensureSpace succeeds. A growable
+//   heap is grown in that case, otherwise ErrOutOfSpace is returned.
+func (fbha *FreeingBumpHeapAllocator) bump(qty uint32) (uint32, error) {
+	required := uint64(fbha.bumper) + uint64(qty)
+	if required > uint64(fbha.maxHeapSize) && fbha.growable && required <= uint64(^uint32(0)) {
+		err := fbha.grow(uint32(required) - fbha.maxHeapSize)
+		if err != nil {
+			fbha.logger.Debug("[bump]", "failed to grow heap", err)
+		}
+	}
+	if required > uint64(fbha.maxHeapSize) {
+		return 0, ErrOutOfSpace
+	}
+
 	res := fbha.bumper
 	fbha.bumper += qty
-	return res
+	return res, nil
+}
+
+// zero clears size bytes of the heap starting at ptr
+func (fbha *FreeingBumpHeapAllocator) zero(ptr uint32, size uint32) {
+	payload := fbha.heap.Data()[fbha.ptrOffset+ptr : fbha.ptrOffset+ptr+size]
+	for i := range payload {
+		payload[i] = 0
+	}
+}
+
+// setLiveHeader writes the "header" of the allocated block at ptr to the heap. A reused block has its free list link
+//  where the list index and markers go, so all 8 bytes are rewritten, through one slice of the heap data
+func (fbha *FreeingBumpHeapAllocator) setLiveHeader(ptr uint32, listIndex uint8) {
+	header := fbha.heap.Data()[fbha.ptrOffset+ptr-8 : fbha.ptrOffset+ptr]
+	header[0] = listIndex
+	for i := 1; i < 8; i++ {
+		header[i] = liveMarker
+	}
 }
 
 func (fbha *FreeingBumpHeapAllocator) setHeap(ptr uint32, value uint8) {
@@ -167,10 +1074,15 @@ func getItemSizeFromIndex(index uint) uint {
 	return 1 << 3 << index
 }
 
+// nextPowerOf2GT8 rounds v up to a power of two of at least 8, clamped to MaxPossibleAllocation
+//  so that sizes close to 2^32 can't overflow to 0
 func nextPowerOf2GT8(v uint32) uint32 {
 	if v < 8 {
 		return 8
 	}
+	if v > MaxPossibleAllocation {
+		return MaxPossibleAllocation
+	}
 	v--
 	v |= v >> 1
 	v |= v >> 2
@@ -0,0 +1,139 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"testing"
+)
+
+// number of blocks allocated by every iteration of the benchmarks
+const benchBlocks = 256
+
+// utility function to create an allocator on a wasm memory of the default, fixed size
+func newBenchAllocator(b *testing.B) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return fbha
+}
+
+// allocateBlocks fills ptrs with allocations of size
+func allocateBlocks(b *testing.B, fbha *FreeingBumpHeapAllocator, ptrs []uint32, size uint32) {
+	var err error
+	for i := range ptrs {
+		ptrs[i], err = fbha.Allocate(size)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmark allocations that always bump, the heap is cleared with FreeAll between iterations
+func BenchmarkAllocateSequential(b *testing.B) {
+	fbha := newBenchAllocator(b)
+	ptrs := make([]uint32, benchBlocks)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		allocateBlocks(b, fbha, ptrs, 32)
+		fbha.FreeAll()
+	}
+	b.ReportMetric(benchBlocks, "allocations/op")
+}
+
+// benchmark freeing in reverse order, so the free list hands blocks back in the order they were bumped
+func BenchmarkAllocateFreeLIFO(b *testing.B) {
+	fbha := newBenchAllocator(b)
+	ptrs := make([]uint32, benchBlocks)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		allocateBlocks(b, fbha, ptrs, 32)
+		for j := len(ptrs) - 1; j >= 0; j-- {
+			err := fbha.Deallocate(ptrs[j])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(benchBlocks, "allocations/op")
+}
+
+// benchmark freeing in allocation order, so the free list hands blocks back reversed
+func BenchmarkAllocateFreeFIFO(b *testing.B) {
+	fbha := newBenchAllocator(b)
+	ptrs := make([]uint32, benchBlocks)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		allocateBlocks(b, fbha, ptrs, 32)
+		for _, ptr := range ptrs {
+			err := fbha.Deallocate(ptr)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(benchBlocks, "allocations/op")
+}
+
+// benchmark an adversarial churn: every other block of mixed sizes up to 512 bytes is freed and followed by
+// allocations of 1 KiB and more, which the free lists of the smaller size classes can't serve. The bytes
+// bumped but sitting in free lists at the end of the churn are reported as wasted to fragmentation.
+func BenchmarkAllocateMixedChurn(b *testing.B) {
+	fbha := newBenchAllocator(b)
+	ptrs := make([]uint32, benchBlocks)
+	var wasted uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		for j := range ptrs {
+			ptrs[j], err = fbha.Allocate(uint32(8 << (j % 7)))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		for j := 1; j < len(ptrs); j += 2 {
+			err = fbha.Deallocate(ptrs[j])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		for j := 1; j < len(ptrs); j += 2 {
+			ptrs[j], err = fbha.Allocate(uint32(1024 << (j % 3)))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		stats := fbha.Stats()
+		wasted += uint64(stats.Bumper - stats.TotalSize)
+		fbha.FreeAll()
+	}
+	b.ReportMetric(benchBlocks*3/2, "allocations/op")
+	b.ReportMetric(float64(wasted)/float64(b.N), "wasted-bytes/op")
+}
@@ -18,18 +18,21 @@ package runtime
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"math"
+	"math/bits"
+	"math/rand"
 	"net/http"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 
+	log "github.com/ChainSafe/log15"
 	wasm "github.com/wasmerio/go-ext-wasm/wasmer"
 )
 
-const pageSize = 65536
-
 // struct to hold data for a round of tests
 type testHolder struct {
 	offset uint32
@@ -49,7 +52,7 @@ type freeTest struct {
 // struct to hold data used for expected allocator state
 type allocatorState struct {
 	bumper    uint32
-	heads     [HeadsQty]uint32
+	heads     map[int]uint32 // heads of the free lists holding blocks, by list index
 	ptrOffset uint32
 	totalSize uint32
 }
@@ -107,7 +110,7 @@ var allocateFreeTest = []testSet{
 			totalSize: 40}},
 	{test: &freeTest{ptr: 24}, // address of second allocation
 		state: allocatorState{bumper: 40,
-			heads:     [22]uint32{0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			heads:     map[int]uint32{1: 16},
 			totalSize: 16}},
 }
 
@@ -125,7 +128,7 @@ var allocateDeallocateReallocateWithOffset = []testSet{
 			totalSize: 40}},
 	{test: &freeTest{ptr: 40}, // address of second allocation
 		state: allocatorState{bumper: 40,
-			heads:     [22]uint32{0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			heads:     map[int]uint32{1: 16},
 			ptrOffset: 16,
 			totalSize: 16}},
 	{test: &allocateTest{size: 9},
@@ -154,23 +157,35 @@ var allocateShouldBuildFreeList = []testSet{
 	// free first allocation
 	{test: &freeTest{ptr: 8}, // address of first allocation
 		state: allocatorState{bumper: 48,
+			heads:     map[int]uint32{0: 0},
 			totalSize: 32}},
 	// free second allocation
 	{test: &freeTest{ptr: 24}, // address of second allocation
 		state: allocatorState{bumper: 48,
-			heads:     [22]uint32{16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			heads:     map[int]uint32{0: 16},
 			totalSize: 16}},
 	// free third allocation
 	{test: &freeTest{ptr: 40}, // address of third allocation
 		state: allocatorState{bumper: 48,
-			heads:     [22]uint32{32, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			heads:     map[int]uint32{0: 32},
 			totalSize: 0}},
 	// allocate 8 bytes
 	{test: &allocateTest{size: 8},
 		output: uint32(40),
 		state: allocatorState{bumper: 48,
-			heads:     [22]uint32{16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			heads:     map[int]uint32{0: 16},
 			totalSize: 16}},
+	// allocate 8 bytes
+	{test: &allocateTest{size: 8},
+		output: uint32(24),
+		state: allocatorState{bumper: 48,
+			heads:     map[int]uint32{0: 0},
+			totalSize: 32}},
+	// allocate 8 bytes, reusing the block at offset 0
+	{test: &allocateTest{size: 8},
+		output: uint32(8),
+		state: allocatorState{bumper: 48,
+			totalSize: 48}},
 }
 
 // allocate 9 byte test with allocator memory offset
@@ -192,6 +207,7 @@ var heapShouldBeZeroAfterFreeWithOffset = []testSet{
 
 	{test: &freeTest{ptr: 24},
 		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 16,
 			totalSize: 0}},
 }
@@ -206,54 +222,55 @@ var heapShouldBeZeroAfterFreeWithOffsetFiveTimes = []testSet{
 	// first free
 	{test: &freeTest{ptr: 32},
 		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 24,
 			totalSize: 0}},
 	// second alloc
 	{test: &allocateTest{size: 42},
-		output: uint32(104),
-		state: allocatorState{bumper: 144,
+		output: uint32(32),
+		state: allocatorState{bumper: 72,
 			ptrOffset: 24,
 			totalSize: 72}},
 	// second free
-	{test: &freeTest{ptr: 104},
-		state: allocatorState{bumper: 144,
-			heads:     [22]uint32{0, 0, 0, 72, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	{test: &freeTest{ptr: 32},
+		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 24,
 			totalSize: 0}},
 	// third alloc
 	{test: &allocateTest{size: 42},
-		output: uint32(104),
-		state: allocatorState{bumper: 144,
+		output: uint32(32),
+		state: allocatorState{bumper: 72,
 			ptrOffset: 24,
 			totalSize: 72}},
 	// third free
-	{test: &freeTest{ptr: 104},
-		state: allocatorState{bumper: 144,
-			heads:     [22]uint32{0, 0, 0, 72, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	{test: &freeTest{ptr: 32},
+		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 24,
 			totalSize: 0}},
 	// forth alloc
 	{test: &allocateTest{size: 42},
-		output: uint32(104),
-		state: allocatorState{bumper: 144,
+		output: uint32(32),
+		state: allocatorState{bumper: 72,
 			ptrOffset: 24,
 			totalSize: 72}},
 	// forth free
-	{test: &freeTest{ptr: 104},
-		state: allocatorState{bumper: 144,
-			heads:     [22]uint32{0, 0, 0, 72, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	{test: &freeTest{ptr: 32},
+		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 24,
 			totalSize: 0}},
 	// fifth alloc
 	{test: &allocateTest{size: 42},
-		output: uint32(104),
-		state: allocatorState{bumper: 144,
+		output: uint32(32),
+		state: allocatorState{bumper: 72,
 			ptrOffset: 24,
 			totalSize: 72}},
 	// fifth free
-	{test: &freeTest{ptr: 104},
-		state: allocatorState{bumper: 144,
-			heads:     [22]uint32{0, 0, 0, 72, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	{test: &freeTest{ptr: 32},
+		state: allocatorState{bumper: 72,
+			heads:     map[int]uint32{3: 0},
 			ptrOffset: 24,
 			totalSize: 0}},
 }
@@ -323,7 +340,10 @@ func TestAllocator(t *testing.T) {
 			t.Fatal(err)
 		}
 		t.Log("mem", "mem", mem)
-		allocator := NewAllocator(mem, test.offset)
+		allocator, err := NewAllocator(mem, test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		for _, theTest := range test.tests {
 			switch v := theTest.test.(type) {
@@ -334,7 +354,7 @@ func TestAllocator(t *testing.T) {
 					t.Fatal(err1)
 				}
 
-				compareState(*allocator, theTest.state, result, theTest.output, t)
+				compareState(allocator, theTest.state, result, theTest.output, t)
 
 			case *freeTest:
 				t.Log("got free", v.ptr)
@@ -343,7 +363,7 @@ func TestAllocator(t *testing.T) {
 					t.Fatal(err)
 				}
 				t.Log("heads", allocator.heads[:])
-				compareState(*allocator, theTest.state, nil, theTest.output, t)
+				compareState(allocator, theTest.state, nil, theTest.output, t)
 			default:
 				t.Log("default type")
 			}
@@ -352,7 +372,7 @@ func TestAllocator(t *testing.T) {
 }
 
 // compare test results to expected results and fail test if differences are found
-func compareState(allocator FreeingBumpHeapAllocator, state allocatorState, result interface{}, output interface{}, t *testing.T) {
+func compareState(allocator *FreeingBumpHeapAllocator, state allocatorState, result interface{}, output interface{}, t *testing.T) {
 	t.Log("allocatorState", allocator)
 	t.Log("allocatorExpected", state)
 	t.Log("result:", result)
@@ -360,8 +380,8 @@ func compareState(allocator FreeingBumpHeapAllocator, state allocatorState, resu
 	if !reflect.DeepEqual(allocator.bumper, state.bumper) {
 		t.Errorf("Fail: got %v expected %v", allocator.bumper, state.bumper)
 	}
-	if !reflect.DeepEqual(allocator.heads, state.heads) {
-		t.Errorf("Fail: got %v expected %v", allocator.heads, state.heads)
+	if heads := nonEmptyHeads(allocator.heads); !reflect.DeepEqual(heads, state.heads) {
+		t.Errorf("Fail: got %v expected %v", heads, state.heads)
 	}
 	if !reflect.DeepEqual(allocator.ptrOffset, state.ptrOffset) {
 		t.Errorf("Fail: got %v expected %v", allocator.ptrOffset, state.ptrOffset)
@@ -374,6 +394,21 @@ func compareState(allocator FreeingBumpHeapAllocator, state allocatorState, resu
 	}
 }
 
+// nonEmptyHeads returns the heads of the free lists holding blocks, by list index
+func nonEmptyHeads(heads []uint32) map[int]uint32 {
+	var lists map[int]uint32
+	for i, head := range heads {
+		if head == freeListEnd {
+			continue
+		}
+		if lists == nil {
+			lists = make(map[int]uint32)
+		}
+		lists[i] = head
+	}
+	return lists
+}
+
 // test that allocator should no allocate memory if the allocate
 //  request is larger than current size
 func TestShouldNotAllocateIfTooLarge(t *testing.T) {
@@ -384,7 +419,10 @@ func TestShouldNotAllocateIfTooLarge(t *testing.T) {
 	}
 	currentSize := mem.Length()
 
-	fbha := NewAllocator(mem, 0)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// when
 	_, err = fbha.Allocate(currentSize + 1)
@@ -393,7 +431,7 @@ func TestShouldNotAllocateIfTooLarge(t *testing.T) {
 	if err == nil {
 		t.Error("Error, expected out of space error, but didn't get one.")
 	}
-	if err != nil && err.Error() != "allocator out of space" {
+	if err != nil && !errors.Is(err, ErrOutOfSpace) {
 		t.Errorf("Error: got unexpected error: %v", err.Error())
 	}
 }
@@ -407,7 +445,10 @@ func TestShouldNotAllocateIfFull(t *testing.T) {
 		t.Fatal(err)
 	}
 	currentSize := mem.Length()
-	fbha := NewAllocator(mem, 0)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ptr1, err := fbha.Allocate((currentSize / 2) - 8)
 	if err != nil {
@@ -425,7 +466,7 @@ func TestShouldNotAllocateIfFull(t *testing.T) {
 	if err == nil {
 		t.Error("Error, expected out of space error, but didn't get one.")
 	}
-	if err != nil && err.Error() != "allocator out of space" {
+	if err != nil && !errors.Is(err, ErrOutOfSpace) {
 		t.Errorf("Error: got unexpected error: %v", err.Error())
 	}
 
@@ -443,7 +484,10 @@ func TestShouldAllocateMaxPossibleAllocationSize(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	fbha := NewAllocator(mem, 0)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// when
 	ptr1, err := fbha.Allocate(MaxPossibleAllocation)
@@ -465,14 +509,18 @@ func TestShouldNotAllocateIfRequestSizeTooLarge(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fbha := NewAllocator(mem, 0)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// when
-	_, err = fbha.Allocate(MaxPossibleAllocation + 1)
+	// when, sizes above MaxPossibleAllocation take the large-object path, which still has to round
+	//  the size up to whole pages
+	_, err = fbha.Allocate(math.MaxUint32)
 
 	// then
 	if err != nil {
-		if err.Error() != "size to large" {
+		if !errors.Is(err, ErrSizeTooLarge) {
 			t.Error("Didn't get expected error")
 		}
 	} else {
@@ -544,3 +592,1618 @@ func TestShouldGetMaxFromIndex(t *testing.T) {
 		t.Errorf("item_size should be %d, got item_size: %d", MaxPossibleAllocation, itemSize)
 	}
 }
+
+// test that concurrent allocations and frees from several goroutines leave the
+//  heap consistent, each goroutine checks its header and payload before freeing
+func TestShouldAllocateConcurrently(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const routines = 8
+	const rounds = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(id)))
+			pattern := byte(id + 1)
+
+			for j := 0; j < rounds; j++ {
+				size := uint32(r.Intn(1024) + 1)
+				ptr, err := fbha.Allocate(size)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				payload := mem.Data()[ptr : ptr+size]
+				for k := range payload {
+					payload[k] = pattern
+				}
+
+				listIndex := bits.TrailingZeros32(nextPowerOf2GT8(size)) - 3
+				if mem.Data()[ptr-8] != uint8(listIndex) {
+					t.Errorf("header clobbered at %d: got %d expected %d", ptr, mem.Data()[ptr-8], listIndex)
+				}
+				for k := range payload {
+					if payload[k] != pattern {
+						t.Errorf("payload clobbered at %d: got %d expected %d", ptr+uint32(k), payload[k], pattern)
+						break
+					}
+				}
+
+				err = fbha.Deallocate(ptr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if fbha.TotalSize != 0 {
+		t.Errorf("Fail: got total size %d expected 0", fbha.TotalSize)
+	}
+}
+
+// test that after Reset the allocator hands out the same pointers as a freshly
+//  constructed one
+func TestShouldAllocateFromStartAfterReset(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbha.Reset()
+
+	compareState(fbha, allocatorState{ptrOffset: 16}, nil, nil, t)
+	if fbha.heap != mem {
+		t.Error("Fail: heap memory was not kept after Reset")
+	}
+
+	ptr, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != first {
+		t.Errorf("Fail: got %d expected %d", ptr, first)
+	}
+}
+
+// test that Stats reports the allocator state and counts free list entries
+func TestShouldReportStats(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []uint32{8, 8, 8, 16, 100, 100}
+	ptrs := make([]uint32, len(sizes))
+	for i, size := range sizes {
+		ptrs[i], err = fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// free three 8 byte blocks, the 16 byte block and one 128 byte block
+	for _, ptr := range ptrs[:5] {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := fbha.Stats()
+
+	expected := AllocatorStats{
+		TotalSize:   136,
+		Bumper:      16*3 + 24 + 136*2,
+		MaxHeapSize: mem.Length(),
+		FreeBlocks:  make([]uint32, HeadsQty),
+	}
+	expected.FreeBlocks[0] = 3
+	expected.FreeBlocks[1] = 1
+	expected.FreeBlocks[4] = 1
+
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Fail: got %+v expected %+v", stats, expected)
+	}
+}
+
+// test that Stats terminates when a corrupted free list loops back on itself
+func TestShouldCapStatsOnCorruptedFreeList(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point the freed block's link at itself
+	binary.LittleEndian.PutUint32(mem.Data()[ptr-8:], ptr-8)
+
+	stats := fbha.Stats()
+	if stats.FreeBlocks[0] != fbha.bumper/16 {
+		t.Errorf("Fail: got %d expected %d", stats.FreeBlocks[0], fbha.bumper/16)
+	}
+}
+
+// test that a growable allocator grows the wasm memory instead of running out of space
+func TestShouldGrowHeapWhenFull(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentSize := mem.Length()
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{Growable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(currentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 8 {
+		t.Errorf("Fail: got %d expected 8", ptr)
+	}
+
+	itemSize := nextPowerOf2GT8(currentSize)
+	expectedPages := (itemSize + 8 - currentSize + pageSize - 1) / pageSize
+	if mem.Length() != currentSize+expectedPages*pageSize {
+		t.Errorf("Fail: got memory length %d expected %d", mem.Length(), currentSize+expectedPages*pageSize)
+	}
+	if fbha.maxHeapSize != mem.Length() {
+		t.Errorf("Fail: got max heap size %d expected %d", fbha.maxHeapSize, mem.Length())
+	}
+}
+
+// test that rounding up to a power of two is clamped to MaxPossibleAllocation instead of overflowing
+func TestShouldClampNextPowerOf2(t *testing.T) {
+	testCases := []struct {
+		size     uint32
+		expected uint32
+	}{
+		{size: 0, expected: 8},
+		{size: 9, expected: 16},
+		{size: MaxPossibleAllocation - 1, expected: MaxPossibleAllocation},
+		{size: MaxPossibleAllocation, expected: MaxPossibleAllocation},
+		{size: MaxPossibleAllocation + 1, expected: MaxPossibleAllocation},
+		{size: 1<<31 + 1, expected: MaxPossibleAllocation},
+		{size: math.MaxUint32, expected: MaxPossibleAllocation},
+	}
+
+	for _, test := range testCases {
+		res := nextPowerOf2GT8(test.size)
+		if res != test.expected {
+			t.Errorf("Fail: size %d got %d expected %d", test.size, res, test.expected)
+		}
+	}
+}
+
+// test that a small block allocation rejects the clamped bucket of a size above MaxPossibleAllocation
+func TestShouldNotAllocateSmallBlockAboveMax(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []uint32{MaxPossibleAllocation + 1, math.MaxUint32} {
+		_, err = fbha.allocateSmall(size)
+		if !errors.Is(err, ErrSizeTooLarge) {
+			t.Errorf("Fail: size %d got %v expected %v", size, err, ErrSizeTooLarge)
+		}
+	}
+	compareState(fbha, allocatorState{}, nil, nil, t)
+}
+
+// test that with fewer size classes allocations above the largest one are rejected
+func TestShouldLimitSizeClasses(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// classes of 8 to 128 bytes
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{SizeClasses: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 8 || fbha.getHeapByte(0) != 4 {
+		t.Errorf("Fail: got pointer %d list index %d expected 8 4", ptr, fbha.getHeapByte(0))
+	}
+	for _, size := range []uint32{129, MaxPossibleAllocation} {
+		_, err = fbha.Allocate(size)
+		if !errors.Is(err, ErrSizeTooLarge) {
+			t.Errorf("Fail: size %d got %v expected %v", size, err, ErrSizeTooLarge)
+		}
+		if fbha.CanAllocate(size) {
+			t.Errorf("Fail: expected size %d not to be allocatable", size)
+		}
+	}
+	compareState(fbha, allocatorState{bumper: 136, totalSize: 136}, nil, nil, t)
+
+	// the free lists, stats and histogram have one entry per class
+	if len(fbha.heads) != 5 || len(fbha.Stats().FreeBlocks) != 5 || len(fbha.AllocationHistogram()) != 5 {
+		t.Errorf("Fail: got %d free lists %d stats %d histogram entries expected 5", len(fbha.heads),
+			len(fbha.Stats().FreeBlocks), len(fbha.AllocationHistogram()))
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareState(fbha, allocatorState{bumper: 136, heads: map[int]uint32{4: 0}}, nil, nil, t)
+
+	// the class count has to fit HeadsQty and the alignment
+	for _, cfg := range []AllocatorConfig{
+		{SizeClasses: -1},
+		{SizeClasses: HeadsQty + 1},
+		{SizeClasses: 3, Alignment: 64},
+	} {
+		_, err = NewAllocatorWithConfig(mem, 0, cfg)
+		if err == nil {
+			t.Errorf("Fail: expected an error for %d size classes with alignment %d", cfg.SizeClasses, cfg.Alignment)
+		}
+	}
+	_, err = NewAllocatorWithConfig(mem, 0, AllocatorConfig{SizeClasses: HeadsQty})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that a growable allocator still reports out of space if the memory can't grow
+func TestShouldNotAllocateIfGrowFails(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentSize := mem.Length()
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{Growable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha.growMemory = func(pages uint32) error {
+		return errors.New("cannot grow")
+	}
+
+	_, err = fbha.Allocate(currentSize)
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Errorf("Fail: got %v expected out of space error", err)
+	}
+	if fbha.maxHeapSize != currentSize {
+		t.Errorf("Fail: got max heap size %d expected %d", fbha.maxHeapSize, currentSize)
+	}
+}
+
+// test that the default allocator never grows the wasm memory
+func TestShouldNotGrowHeapIfNotGrowable(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentSize := mem.Length()
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(currentSize)
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Errorf("Fail: got %v expected out of space error", err)
+	}
+	if mem.Length() != currentSize {
+		t.Errorf("Fail: got memory length %d expected %d", mem.Length(), currentSize)
+	}
+}
+
+// test that TotalSize can't wrap around, neither below 0 when freeing nor above the maximum when allocating
+func TestShouldCheckTotalSizeAccounting(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an extra free leaves the total size alone
+	err = fbha.Deallocate(ptr)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+	if fbha.TotalSize != 0 {
+		t.Errorf("Fail: got total size %d expected 0", fbha.TotalSize)
+	}
+
+	// with corrupted accounting the free would underflow, so the block stays live
+	ptr, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha.TotalSize = 8
+	err = fbha.Deallocate(ptr)
+	if !errors.Is(err, ErrAccountingUnderflow) {
+		t.Errorf("Fail: got %v expected %v", err, ErrAccountingUnderflow)
+	}
+	if fbha.TotalSize != 8 || !fbha.isLive(ptr-fbha.ptrOffset) {
+		t.Errorf("Fail: got total size %d and live %v expected 8 true", fbha.TotalSize, fbha.isLive(ptr-fbha.ptrOffset))
+	}
+
+	// an allocation that would wrap the total size around is out of space
+	fbha.TotalSize = ^uint32(0) - 8
+	_, err = fbha.Allocate(8)
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Errorf("Fail: got %v expected %v", err, ErrOutOfSpace)
+	}
+	if fbha.TotalSize != ^uint32(0)-8 {
+		t.Errorf("Fail: got total size %d expected %d", fbha.TotalSize, ^uint32(0)-8)
+	}
+}
+
+// test that a live block can be freed, a second free of it is reported as a double free,
+//  and a pointer that was never handed out is rejected
+func TestShouldDetectDoubleFree(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// legitimate free
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.TotalSize != 72 {
+		t.Errorf("Fail: got total size %d expected 72", fbha.TotalSize)
+	}
+
+	// double free
+	err = fbha.Deallocate(ptr)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+	if fbha.TotalSize != 72 {
+		t.Errorf("Fail: got total size %d expected 72", fbha.TotalSize)
+	}
+
+	// never allocated, both inside a live block and past the bumper
+	for _, p := range []uint32{other + 16, fbha.bumper + 64} {
+		err = fbha.Deallocate(p)
+		if !errors.Is(err, ErrInvalidPointer) {
+			t.Errorf("Fail: got %v expected %v for %d", err, ErrInvalidPointer, p)
+		}
+	}
+
+	// the freed block is still reused once
+	reused, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != ptr {
+		t.Errorf("Fail: got %d expected %d", reused, ptr)
+	}
+}
+
+// test that every failure path returns an error matching its sentinel with errors.Is
+func TestShouldReturnTypedErrors(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(math.MaxUint32)
+	if !errors.Is(err, ErrSizeTooLarge) {
+		t.Errorf("Fail: got %v expected %v", err, ErrSizeTooLarge)
+	}
+
+	_, err = fbha.Allocate(mem.Length())
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Errorf("Fail: got %v expected %v", err, ErrOutOfSpace)
+	}
+
+	err = fbha.Deallocate(4)
+	if !errors.Is(err, ErrInvalidPointer) {
+		t.Errorf("Fail: got %v expected %v", err, ErrInvalidPointer)
+	}
+}
+
+// test that with ZeroOnAlloc a reused block is handed out with a zeroed payload
+func TestShouldZeroPayloadOnAllocate(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{ZeroOnAlloc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := mem.Data()[ptr : ptr+32]
+	for i := range payload {
+		payload[i] = 0xAB
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reused, err := fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != ptr {
+		t.Fatalf("Fail: got %d expected %d", reused, ptr)
+	}
+	if !reflect.DeepEqual(mem.Data()[reused:reused+32], make([]byte, 32)) {
+		t.Errorf("Fail: got payload %x expected zeroes", mem.Data()[reused:reused+32])
+	}
+	if mem.Data()[reused-8] != 2 {
+		t.Errorf("Fail: got list index %d expected 2", mem.Data()[reused-8])
+	}
+}
+
+// test that with ScrubOnFree a freed block's payload is zeroed while its free list link is kept
+func TestShouldScrubPayloadOnDeallocate(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, twentyMiB+2*pageSize)
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{ScrubOnFree: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{32, 32, twentyMiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []uint32{32, 32, twentyMiB}
+	for i, ptr := range ptrs {
+		payload := mem.Data()[ptr : ptr+sizes[i]]
+		for j := range payload {
+			payload[j] = 0xAB
+		}
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mem.Data()[ptr:ptr+sizes[i]], make([]byte, sizes[i])) {
+			t.Errorf("Fail: pointer %d still holds payload bytes", ptr)
+		}
+	}
+
+	// the second block links to the first one in the 32 byte free list
+	if link := binary.LittleEndian.Uint32(mem.Data()[ptrs[1]-8:]); link != ptrs[0]-8 {
+		t.Errorf("Fail: got link %d expected %d", link, ptrs[0]-8)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reused, err := fbha.AllocateBatch([]uint32{32, 32, twentyMiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint32{ptrs[1], ptrs[0], ptrs[2]}
+	if !reflect.DeepEqual(reused, expected) {
+		t.Errorf("Fail: got %v expected %v", reused, expected)
+	}
+}
+
+// test that an allocator relocated to a larger copy of its memory keeps its state and extends its heap
+func TestShouldRelocateToLargerMemory(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{8, 8, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(mem.Data()[ptrs[2]:], "payload")
+
+	larger := newSeparateWasmMemory(t, mem, 3*1024*1024)
+	copy(larger.Data(), mem.Data())
+	err = fbha.Relocate(larger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareState(fbha, allocatorState{bumper: 168, heads: map[int]uint32{0: 16}, ptrOffset: 16, totalSize: 16 + 136}, nil, nil, t)
+	if fbha.maxHeapSize != larger.Length()-16 {
+		t.Errorf("Fail: got max heap size %d expected %d", fbha.maxHeapSize, larger.Length()-16)
+	}
+	if string(larger.Data()[ptrs[2]:ptrs[2]+7]) != "payload" {
+		t.Errorf("Fail: got payload %q", larger.Data()[ptrs[2]:ptrs[2]+7])
+	}
+
+	// the free list is reused from the new memory, and the extra space can be allocated
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != ptrs[1] {
+		t.Errorf("Fail: got %d expected %d", ptr, ptrs[1])
+	}
+	// the 2 MiB bucket doesn't fit the old memory
+	_, err = fbha.Allocate(mem.Length())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the heap doesn't fit a smaller memory
+	err = fbha.Relocate(mem)
+	if err == nil {
+		t.Error("Fail: expected an error relocating to a smaller memory")
+	}
+}
+
+// test that relocating to the same memory after it was grown outside of the allocator extends the heap
+func TestShouldRelocateToGrownMemory(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSize := mem.Length()
+
+	err = mem.Grow(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Relocate(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.maxHeapSize != oldSize+2*pageSize {
+		t.Errorf("Fail: got max heap size %d expected %d", fbha.maxHeapSize, oldSize+2*pageSize)
+	}
+}
+
+// test that the slice returned by AllocateSlice aliases exactly the payload at the returned pointer
+func TestShouldAllocateSlice(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, buf, err := fbha.AllocateSlice(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 24 || len(buf) != 10 || cap(buf) != 10 {
+		t.Errorf("Fail: got pointer %d len %d cap %d expected 24 10 10", ptr, len(buf), cap(buf))
+	}
+	copy(buf, "0123456789")
+	if string(mem.Data()[ptr:ptr+10]) != "0123456789" {
+		t.Errorf("Fail: got payload %q expected %q", mem.Data()[ptr:ptr+10], "0123456789")
+	}
+
+	// appending reallocates instead of writing over the rest of the bucket
+	buf = append(buf, 'x')
+	buf[0] = 'y'
+	if mem.Data()[ptr] != '0' || mem.Data()[ptr+10] != 0 {
+		t.Errorf("Fail: append wrote to the heap %q", mem.Data()[ptr:ptr+11])
+	}
+
+	// a zero length slice is still handed out with its block
+	ptr, buf, err = fbha.AllocateSlice(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 48 || len(buf) != 0 {
+		t.Errorf("Fail: got pointer %d len %d expected 48 0", ptr, len(buf))
+	}
+
+	_, buf, err = fbha.AllocateSlice(MaxPossibleAllocation)
+	if err == nil || buf != nil {
+		t.Errorf("Fail: expected no slice for a failed allocation, got %d bytes and %v", len(buf), err)
+	}
+}
+
+// test that Realloc keeps the pointer while the new size fits the block's bucket
+func TestShouldReallocInPlace(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// grow within the 16 byte bucket
+	grown, err := fbha.Realloc(ptr, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown != ptr {
+		t.Errorf("Fail: got %d expected %d", grown, ptr)
+	}
+
+	// shrink
+	shrunk, err := fbha.Realloc(ptr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shrunk != ptr {
+		t.Errorf("Fail: got %d expected %d", shrunk, ptr)
+	}
+	compareState(fbha, allocatorState{bumper: 24, totalSize: 24}, nil, nil, t)
+}
+
+// test that Realloc moves the payload to a larger block and frees the old one
+func TestShouldReallocWithCopy(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("sixteen bytes!!!")
+	copy(mem.Data()[ptr:], expected)
+
+	moved, err := fbha.Realloc(ptr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == ptr {
+		t.Fatal("Fail: expected a new pointer")
+	}
+	if !reflect.DeepEqual(mem.Data()[moved:moved+16], expected) {
+		t.Errorf("Fail: got %q expected %q", mem.Data()[moved:moved+16], expected)
+	}
+
+	// the 128 byte block is live, the 16 byte block is back on its list
+	compareState(fbha, allocatorState{
+		bumper:    24 + 136,
+		heads:     map[int]uint32{1: 0},
+		totalSize: 136,
+	}, nil, nil, t)
+
+	_, err = fbha.Realloc(ptr, 200)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+}
+
+// test that the heap size is computed after aligning the pointer offset
+func TestShouldAlignOffsetBeforeSizingHeap(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.ptrOffset != 16 {
+		t.Errorf("Fail: got pointer offset %d expected 16", fbha.ptrOffset)
+	}
+	if fbha.maxHeapSize != mem.Length()-16 {
+		t.Errorf("Fail: got max heap size %d expected %d", fbha.maxHeapSize, mem.Length()-16)
+	}
+}
+
+// test that an offset at or past the end of memory is rejected
+func TestShouldNotCreateAllocatorWithOffsetPastMemory(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last offset aligns up to the memory length
+	for _, offset := range []uint32{mem.Length(), mem.Length() + 1, mem.Length() - 3} {
+		_, err = NewAllocator(mem, offset)
+		if err == nil {
+			t.Errorf("Fail: expected error for offset %d", offset)
+		}
+	}
+}
+
+// test that a batch is allocated in order
+func TestShouldAllocateBatch(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{1, 16, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint32{8, 24, 48}
+	if !reflect.DeepEqual(ptrs, expected) {
+		t.Errorf("Fail: got %v expected %v", ptrs, expected)
+	}
+	compareState(fbha, allocatorState{
+		bumper:    16 + 24 + 24,
+		totalSize: 16 + 24 + 24,
+	}, nil, nil, t)
+}
+
+// test that a failing batch deallocates the blocks it already allocated
+func TestShouldRollBackFailedBatch(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totalSize := fbha.TotalSize
+
+	// the heap isn't growable, so the last allocation doesn't fit
+	ptrs, err := fbha.AllocateBatch([]uint32{8, 16, MaxPossibleAllocation})
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Fatalf("Fail: got %v expected %v", err, ErrOutOfSpace)
+	}
+	if ptrs != nil {
+		t.Errorf("Fail: got %v expected no pointers", ptrs)
+	}
+	if fbha.TotalSize != totalSize {
+		t.Errorf("Fail: got total size %d expected %d", fbha.TotalSize, totalSize)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rolled back blocks are reused
+	ptrs, err = fbha.AllocateBatch([]uint32{8, 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint32{8, 24}
+	if !reflect.DeepEqual(ptrs, expected) {
+		t.Errorf("Fail: got %v expected %v", ptrs, expected)
+	}
+}
+
+// test that an empty batch allocates nothing
+func TestShouldAllocateEmptyBatch(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 0 {
+		t.Errorf("Fail: got %v expected no pointers", ptrs)
+	}
+	compareState(fbha, allocatorState{}, nil, nil, t)
+}
+
+// test that after FreeAll the allocator behaves like a freshly constructed one
+func TestShouldFreeAll(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []uint32{1, 8, 9, 16, 17, 100, 255, 256, 1000, 4096, 3, 64}
+	for i, size := range sizes {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// free some of the blocks so the free lists aren't empty
+		if i%3 == 0 {
+			err = fbha.Deallocate(ptr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fbha.FreeAll()
+
+	freshMem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := NewAllocator(freshMem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareState(fbha, allocatorState{}, nil, nil, t)
+	for _, size := range sizes {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := fresh.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ptr != expected {
+			t.Errorf("Fail: got %d expected %d", ptr, expected)
+		}
+	}
+	if !reflect.DeepEqual(fbha.Stats(), fresh.Stats()) {
+		t.Errorf("Fail: got %v expected %v", fbha.Stats(), fresh.Stats())
+	}
+}
+
+// test that pointers satisfy the configured alignment
+func TestShouldAlignPointers(t *testing.T) {
+	for _, alignment := range []uint32{0, 8, 16, 32} {
+		mem, err := NewWasmMemory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an unaligned offset is padded to the alignment
+		fbha, err := NewAllocatorWithConfig(mem, 13, AllocatorConfig{Alignment: alignment})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := alignment
+		if expected == 0 {
+			expected = 8
+		}
+
+		var ptrs []uint32
+		for _, size := range []uint32{1, 8, 9, 24, 33, 100, 3} {
+			ptr, err := fbha.Allocate(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ptr%expected != 0 {
+				t.Errorf("Fail: alignment %d got pointer %d for size %d", alignment, ptr, size)
+			}
+			ptrs = append(ptrs, ptr)
+		}
+
+		// reused blocks are aligned too
+		for _, ptr := range ptrs[1:4] {
+			err = fbha.Deallocate(ptr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = fbha.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []uint32{9, 1, 17} {
+			ptr, err := fbha.Allocate(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ptr%expected != 0 {
+				t.Errorf("Fail: alignment %d got reused pointer %d for size %d", alignment, ptr, size)
+			}
+		}
+		err = fbha.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// test that an alignment that isn't a power of two is rejected
+func TestShouldNotCreateAllocatorWithInvalidAlignment(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alignment := range []uint32{3, 24, 2 * pageSize} {
+		_, err = NewAllocatorWithConfig(mem, 0, AllocatorConfig{Alignment: alignment})
+		if err == nil {
+			t.Errorf("Fail: expected error for alignment %d", alignment)
+		}
+	}
+}
+
+// test that the free lists holding freed blocks are reported as warm
+func TestShouldPreferWarmFreeLists(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// free a block into the 16 and the 256 byte lists
+	for _, size := range []uint32{16, 256} {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a live block doesn't warm its list
+	_, err = fbha.Allocate(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := -1; i <= HeadsQty; i++ {
+		expected := i == 1 || i == 5
+		if res := fbha.PreferFreeList(i); res != expected {
+			t.Errorf("Fail: list %d got %v expected %v", i, res, expected)
+		}
+	}
+
+	// reusing the block cools the list again
+	_, err = fbha.Allocate(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.PreferFreeList(1) {
+		t.Errorf("Fail: expected list 1 to be empty after reuse")
+	}
+}
+
+// test that the capacity of an allocation is its bucket size
+func TestShouldReturnAllocatedCapacity(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []uint32{0, 1, 8, 9, 16, 17, 100, 1000, 65536} {
+		ptr, capacity, err := fbha.AllocateSized(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if capacity != nextPowerOf2GT8(size) {
+			t.Errorf("Fail: size %d got capacity %d expected %d", size, capacity, nextPowerOf2GT8(size))
+		}
+		// the header of the next block starts right after the capacity
+		if next := ptr + capacity; fbha.bumper != next {
+			t.Errorf("Fail: size %d got bumper %d expected %d", size, fbha.bumper, next)
+		}
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that DeallocateSized returns the bucket plus header size that was allocated
+func TestShouldReturnDeallocatedSize(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []uint32{0, 1, 8, 9, 100, 65536}
+	expected := []uint32{16, 16, 16, 24, 136, 65544}
+
+	ptrs, err := fbha.AllocateBatch(sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ptr := range ptrs {
+		freed, err := fbha.DeallocateSized(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if freed != expected[i] {
+			t.Errorf("Fail: size %d got %d expected %d", sizes[i], freed, expected[i])
+		}
+	}
+	compareState(fbha, allocatorState{bumper: 65752, heads: nonEmptyHeads(fbha.heads), totalSize: 0}, nil, nil, t)
+
+	freed, err := fbha.DeallocateSized(ptrs[0])
+	if !errors.Is(err, ErrDoubleFree) || freed != 0 {
+		t.Errorf("Fail: got %d %v expected 0 %v", freed, err, ErrDoubleFree)
+	}
+}
+
+// test that the histogram counts every allocation by size class
+func TestShouldCountAllocationHistogram(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{TrackHistogram: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []uint32{1, 8, 9, 16, 17, 100, 128, 5000} {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// freed allocations stay counted
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fbha.FreeAll()
+
+	expected := make([]uint64, HeadsQty)
+	expected[0] = 2  // 8 bytes
+	expected[1] = 2  // 16 bytes
+	expected[2] = 1  // 32 bytes
+	expected[4] = 2  // 128 bytes
+	expected[10] = 1 // 8 KiB
+	if res := fbha.AllocationHistogram(); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Fail: got %v expected %v", res, expected)
+	}
+}
+
+// test that the histogram isn't counted unless enabled
+func TestShouldNotCountAllocationHistogramByDefault(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := fbha.AllocationHistogram(); !reflect.DeepEqual(res, make([]uint64, HeadsQty)) {
+		t.Errorf("Fail: got %v expected an empty histogram", res)
+	}
+}
+
+// test that CanAllocate agrees with Allocate around the out of space boundary
+func TestShouldReportIfAllocationFits(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the heap until less than 32 bytes are left
+	left := fbha.maxHeapSize
+	for size := uint32(MaxPossibleAllocation); size >= 8; size /= 2 {
+		for left >= size+8+16 {
+			_, err = fbha.Allocate(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			left -= size + 8
+		}
+	}
+
+	for _, size := range []uint32{0, 1, 8, 9, 16, 17, 32, MaxPossibleAllocation, MaxPossibleAllocation + 1, math.MaxUint32} {
+		stats := fbha.Stats()
+		can := fbha.CanAllocate(size)
+		if !reflect.DeepEqual(fbha.Stats(), stats) {
+			t.Fatalf("Fail: CanAllocate(%d) changed the allocator state", size)
+		}
+
+		// try the allocation for real and roll it back
+		snapshot := fbha.Snapshot()
+		_, err = fbha.Allocate(size)
+		fbha.Restore(snapshot)
+
+		if can != (err == nil) {
+			t.Errorf("Fail: CanAllocate(%d) got %v but Allocate returned %v", size, can, err)
+		}
+	}
+
+	if !fbha.CanAllocate(8) {
+		t.Fatal("Fail: expected the last block to fit")
+	}
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.CanAllocate(1) {
+		t.Errorf("Fail: expected a full heap")
+	}
+}
+
+// test that CanAllocate agrees with Allocate on a fragmented heap, where blocks of another size class are free
+//  but nothing can be bumped anymore
+func TestShouldReportFragmentedHeapFits(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ptrs []uint32
+	for {
+		ptr, err := fbha.Allocate(16)
+		if err != nil {
+			if !errors.Is(err, ErrOutOfSpace) {
+				t.Fatal(err)
+			}
+			break
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	for _, ptr := range ptrs[:len(ptrs)/2] {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// half of the heap is free, but only as 16 byte blocks
+	for _, size := range []uint32{16, 100} {
+		can := fbha.CanAllocate(size)
+		snapshot := fbha.Snapshot()
+		_, err = fbha.Allocate(size)
+		fbha.Restore(snapshot)
+		if can != (err == nil) {
+			t.Errorf("Fail: CanAllocate(%d) got %v but Allocate returned %v", size, can, err)
+		}
+	}
+	if fbha.CanAllocate(100) {
+		t.Error("Fail: expected no space to bump a 128 byte block")
+	}
+}
+
+// test that a growable allocator reports allocations that need the heap to grow as possible
+func TestShouldReportGrowableAllocationFits(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{Growable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fbha.CanAllocate(MaxPossibleAllocation) {
+		t.Errorf("Fail: expected a growable heap to fit %d bytes", MaxPossibleAllocation)
+	}
+	if fbha.CanAllocate(math.MaxUint32) {
+		t.Errorf("Fail: expected %d bytes to be too large", uint32(math.MaxUint32))
+	}
+}
+
+// test that in arena mode blocks are always bumped, deallocating does nothing and FreeAll
+//  reclaims everything
+func TestShouldBumpInArenaMode(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{ArenaMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr1, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed, err := fbha.DeallocateSized(ptr1)
+	if err != nil || freed != 0 {
+		t.Errorf("Fail: got %d %v expected 0", freed, err)
+	}
+
+	// the freed block isn't reused
+	ptr2, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr2 != ptr1+16 {
+		t.Errorf("Fail: got %d expected %d", ptr2, ptr1+16)
+	}
+	compareState(fbha, allocatorState{bumper: 32, totalSize: 32}, nil, nil, t)
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbha.FreeAll()
+	compareState(fbha, allocatorState{}, nil, nil, t)
+
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != ptr1 {
+		t.Errorf("Fail: got %d expected %d", ptr, ptr1)
+	}
+}
+
+// test that a failed batch in arena mode leaves the bumper, total size, peak and histogram unchanged
+func TestShouldRollBackFailedBatchInArenaMode(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{ArenaMode: true, TrackHistogram: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	histogram := fbha.AllocationHistogram()
+
+	// the heap isn't growable, so the last allocation doesn't fit
+	ptrs, err := fbha.AllocateBatch([]uint32{8, 16, MaxPossibleAllocation})
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Fatalf("Fail: got %v expected %v", err, ErrOutOfSpace)
+	}
+	if ptrs != nil {
+		t.Errorf("Fail: got %v expected no pointers", ptrs)
+	}
+	compareState(fbha, allocatorState{bumper: 16, totalSize: 16}, nil, nil, t)
+	if fbha.PeakUsage() != 16 {
+		t.Errorf("Fail: got peak usage %d expected 16", fbha.PeakUsage())
+	}
+	if res := fbha.AllocationHistogram(); !reflect.DeepEqual(res, histogram) {
+		t.Errorf("Fail: got %v expected %v", res, histogram)
+	}
+
+	// the space of the rolled back blocks is bumped again
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 24 {
+		t.Errorf("Fail: got %d expected 24", ptr)
+	}
+}
+
+// test that a block reused from a free list gets the same header as a freshly bumped one
+func TestShouldRewriteHeaderOfReusedBlock(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bumped := append([]byte(nil), mem.Data()[ptr-8:ptr]...)
+
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused, err := fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != ptr {
+		t.Fatalf("Fail: got %d expected %d", reused, ptr)
+	}
+	if header := mem.Data()[ptr-8 : ptr]; !reflect.DeepEqual(header, bumped) {
+		t.Errorf("Fail: got %v expected %v", header, bumped)
+	}
+
+	// double frees are still detected after reuse
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+}
+
+func BenchmarkAllocateDeallocateReuse(b *testing.B) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ptr, err := fbha.Allocate(8)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkAllocateFreeAll(b *testing.B, cfg AllocatorConfig) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ptrs := make([]uint32, 256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range ptrs {
+			ptrs[j], err = fbha.Allocate(uint32(j%64) + 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		for _, ptr := range ptrs {
+			err = fbha.Deallocate(ptr)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		fbha.FreeAll()
+	}
+}
+
+func BenchmarkAllocateFreeAll(b *testing.B) {
+	benchmarkAllocateFreeAll(b, AllocatorConfig{})
+}
+
+func BenchmarkAllocateFreeAllArenaMode(b *testing.B) {
+	benchmarkAllocateFreeAll(b, AllocatorConfig{ArenaMode: true})
+}
+
+// test that the peak usage keeps the highest total size through frees, smaller allocations and FreeAll
+func TestShouldTrackPeakUsage(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{100, 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peak := uint32(128 + 8 + 1024 + 8)
+	if fbha.PeakUsage() != peak {
+		t.Errorf("Fail: got %d expected %d", fbha.PeakUsage(), peak)
+	}
+
+	for _, ptr := range ptrs {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.PeakUsage() != peak {
+		t.Errorf("Fail: got %d expected %d", fbha.PeakUsage(), peak)
+	}
+
+	fbha.FreeAll()
+	if fbha.PeakUsage() != peak {
+		t.Errorf("Fail: got %d expected %d", fbha.PeakUsage(), peak)
+	}
+
+	fbha.ResetPeak()
+	if fbha.PeakUsage() != 0 {
+		t.Errorf("Fail: got %d expected 0", fbha.PeakUsage())
+	}
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.PeakUsage() != 16 {
+		t.Errorf("Fail: got %d expected 16", fbha.PeakUsage())
+	}
+}
+
+// test that an injected logger is used for the allocator's debug lines, with its own context
+func TestShouldLogToInjectedLogger(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*log.Record
+	logger := log.New("instance", 7)
+	logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		msg string
+		ctx []interface{}
+	}{
+		{msg: "[Allocate]", ctx: []interface{}{"instance", 7, "heap_size after allocation", uint32(16)}},
+		{msg: "[Deallocate]", ctx: []interface{}{"instance", 7, "ptr", uint32(8)}},
+		{msg: "[Deallocate]", ctx: []interface{}{"instance", 7, "heap total_size after Deallocate", uint32(0)}},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Fail: got %d records expected %d", len(records), len(expected))
+	}
+	for i, record := range records {
+		if record.Lvl != log.LvlDebug || record.Msg != expected[i].msg {
+			t.Errorf("Fail: got %v %s expected %v %s", record.Lvl, record.Msg, log.LvlDebug, expected[i].msg)
+		}
+		if !reflect.DeepEqual(record.Ctx, expected[i].ctx) {
+			t.Errorf("Fail: got %v expected %v", record.Ctx, expected[i].ctx)
+		}
+	}
+}
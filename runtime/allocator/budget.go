@@ -0,0 +1,82 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCallBudgetExceeded is returned when an allocation would exceed the budget set by BeginCall
+	ErrCallBudgetExceeded = errors.New("allocation budget of the call exceeded")
+	// ErrCallActive is returned by BeginCall if the budget of an earlier call wasn't ended yet
+	ErrCallActive = errors.New("allocation budget of a call is already active")
+)
+
+// A call budget limits the bytes a single runtime call may allocate, on top of the limit of the heap
+// itself. The requested sizes of all allocations made between BeginCall and EndCall are summed, freeing
+// memory doesn't give any budget back. Only the blocks of a failed AllocateBatch, which are never handed
+// out, are taken back off the budget. Budgets don't nest, a call has to end before the next one begins.
+
+// BeginCall starts tracking the allocations of a runtime call, failing any allocation that would take them
+//   above maxBytes with ErrCallBudgetExceeded. It returns ErrCallActive if a call is already active.
+func (fbha *FreeingBumpHeapAllocator) BeginCall(maxBytes uint32) error {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	if fbha.callActive {
+		return fmt.Errorf("cannot begin call with budget of %d bytes: %w", maxBytes, ErrCallActive)
+	}
+	fbha.callActive = true
+	fbha.callBudget = maxBytes
+	fbha.callAllocated = 0
+	return nil
+}
+
+// EndCall stops tracking the allocations of the active call, it's a no-op if there is none
+func (fbha *FreeingBumpHeapAllocator) EndCall() {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	fbha.callActive = false
+	fbha.callBudget = 0
+	fbha.callAllocated = 0
+}
+
+// checkCallBudget returns ErrCallBudgetExceeded if allocating size bytes would exceed the active call's budget
+func (fbha *FreeingBumpHeapAllocator) checkCallBudget(size uint32) error {
+	if fbha.callActive && fbha.callAllocated+uint64(size) > uint64(fbha.callBudget) {
+		return fmt.Errorf("cannot allocate %d bytes after %d of %d bytes in call: %w", size, fbha.callAllocated, fbha.callBudget, ErrCallBudgetExceeded)
+	}
+	return nil
+}
+
+// chargeCall adds an allocation of size bytes to the active call
+func (fbha *FreeingBumpHeapAllocator) chargeCall(size uint32) {
+	if fbha.callActive {
+		fbha.callAllocated += uint64(size)
+	}
+}
+
+// refundCall takes back the charge of an allocation of size bytes from the active call, for allocations that
+// are rolled back before being handed out
+func (fbha *FreeingBumpHeapAllocator) refundCall(size uint32) {
+	if fbha.callActive {
+		fbha.callAllocated -= uint64(size)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+// utility function to create an allocator on a default wasm memory
+func newBudgetAllocator(t *testing.T) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fbha
+}
+
+// test that allocations within the budget of a call succeed, even after freeing
+func TestShouldAllocateWithinCallBudget(t *testing.T) {
+	fbha := newBudgetAllocator(t)
+
+	err := fbha.BeginCall(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := fbha.Allocate(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// freeing gives no budget back
+	_, err = fbha.Allocate(1)
+	if !errors.Is(err, ErrCallBudgetExceeded) {
+		t.Errorf("Fail: got %v expected %v", err, ErrCallBudgetExceeded)
+	}
+
+	// a new call starts with a fresh budget
+	fbha.EndCall()
+	err = fbha.BeginCall(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that an allocation exceeding the budget of a call fails without allocating
+func TestShouldRejectAllocationOverCallBudget(t *testing.T) {
+	fbha := newBudgetAllocator(t)
+
+	err := fbha.BeginCall(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalSize := fbha.TotalSize
+
+	_, err = fbha.Allocate(33)
+	if !errors.Is(err, ErrCallBudgetExceeded) {
+		t.Errorf("Fail: got %v expected %v", err, ErrCallBudgetExceeded)
+	}
+	_, err = fbha.AllocatePageAligned(33)
+	if !errors.Is(err, ErrCallBudgetExceeded) {
+		t.Errorf("Fail: got %v expected %v", err, ErrCallBudgetExceeded)
+	}
+	if fbha.TotalSize != totalSize {
+		t.Errorf("Fail: got total size %d expected %d", fbha.TotalSize, totalSize)
+	}
+
+	// the remaining budget can still be used
+	_, err = fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// budgets don't nest
+	err = fbha.BeginCall(1024)
+	if !errors.Is(err, ErrCallActive) {
+		t.Errorf("Fail: got %v expected %v", err, ErrCallActive)
+	}
+}
+
+// test that without BeginCall allocations are only limited by the heap
+func TestShouldNotLimitAllocationsWithoutCall(t *testing.T) {
+	fbha := newBudgetAllocator(t)
+
+	// ending a call that never began is a no-op
+	fbha.EndCall()
+
+	_, err := fbha.Allocate(64 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fbha.BeginCall(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha.EndCall()
+	_, err = fbha.Allocate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that CanAllocate reports allocations over the budget of the active call as failing
+func TestShouldCheckCallBudgetInCanAllocate(t *testing.T) {
+	fbha := newBudgetAllocator(t)
+
+	err := fbha.BeginCall(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fbha.CanAllocate(32) {
+		t.Error("Fail: expected the rest of the budget to fit")
+	}
+	if fbha.CanAllocate(33) {
+		t.Error("Fail: expected an allocation over the budget not to fit")
+	}
+
+	fbha.EndCall()
+	if !fbha.CanAllocate(33) {
+		t.Error("Fail: expected no budget after EndCall")
+	}
+}
+
+// test that the blocks of a failed batch don't use up the budget of the call
+func TestShouldRefundFailedBatchFromCallBudget(t *testing.T) {
+	fbha := newBudgetAllocator(t)
+
+	err := fbha.BeginCall(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalSize := fbha.TotalSize
+	_, err = fbha.AllocateBatch([]uint32{40, 40, 40})
+	if !errors.Is(err, ErrCallBudgetExceeded) {
+		t.Errorf("Fail: got %v expected %v", err, ErrCallBudgetExceeded)
+	}
+	if fbha.TotalSize != totalSize {
+		t.Errorf("Fail: got total size %d expected %d", fbha.TotalSize, totalSize)
+	}
+
+	// the whole budget is still available
+	_, err = fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
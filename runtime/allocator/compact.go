@@ -0,0 +1,113 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"encoding/binary"
+)
+
+// Compact lowers the bumper below the free blocks at the top of the heap, removing them from their free
+// lists, and returns the number of bytes reclaimed. The space can then be bumped again by any allocation,
+// e.g. a large one that none of the freed blocks could serve. It's a no-op if the block right below the
+// bumper is live. Compact walks every bumped block, so it's O(n) in the number of blocks.
+func (fbha *FreeingBumpHeapAllocator) Compact() uint32 {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	// find where the run of free blocks ending at the bumper starts
+	top := fbha.bumper
+	for block := uint32(0); block < fbha.bumper; {
+		size, ok := fbha.blockSize(block)
+		if !ok {
+			// a corrupted header, the blocks above it can't be told apart
+			return 0
+		}
+		if !fbha.isFreeBlock(block) {
+			top = fbha.bumper
+		} else if top == fbha.bumper {
+			top = block
+		}
+		block += size
+	}
+
+	for block := top; block < fbha.bumper; {
+		size, _ := fbha.blockSize(block)
+		fbha.unlinkFreeBlock(block)
+		block += size
+	}
+
+	reclaimed := fbha.bumper - top
+	fbha.bumper = top
+	fbha.logger.Debug("[Compact]", "reclaimed", reclaimed, "bumper after Compact", fbha.bumper)
+	return reclaimed
+}
+
+// isFreeBlock checks if the bumped block at offset block is a freed small block or a freed large region
+func (fbha *FreeingBumpHeapAllocator) isFreeBlock(block uint32) bool {
+	ptr := block + fbha.blockPadding(block) + fbha.headerSize()
+	if _, ok := fbha.largeObjects[ptr]; ok {
+		return false
+	}
+	if _, ok := fbha.freedLargeSize(ptr); ok {
+		return true
+	}
+	return fbha.isFreed(ptr)
+}
+
+// unlinkFreeBlock removes the free block at offset block from its free list
+func (fbha *FreeingBumpHeapAllocator) unlinkFreeBlock(block uint32) {
+	ptr := block + fbha.blockPadding(block) + fbha.headerSize()
+	if size, ok := fbha.freedLargeSize(ptr); ok {
+		fbha.freeLargeObjects[size] = removePointer(fbha.freeLargeObjects[size], ptr)
+		delete(fbha.pagePadding, ptr)
+		return
+	}
+
+	if fbha.sideMetadata {
+		listIndex := fbha.metadata[ptr].listIndex
+		fbha.freeBlocks[listIndex] = removePointer(fbha.freeBlocks[listIndex], ptr)
+		delete(fbha.metadata, ptr)
+		return
+	}
+
+	// the free list is singly linked through the headers, so find the block linking to this one
+	header := ptr - 8
+	listIndex := fbha.getHeapByte(ptr - 4)
+	prev := freeListEnd
+	for item := fbha.heads[listIndex]; item != freeListEnd; {
+		next := binary.LittleEndian.Uint32(fbha.getHeap4bytes(item))
+		if item == header {
+			if prev == freeListEnd {
+				fbha.heads[listIndex] = next
+			} else {
+				fbha.setHeap4bytes(prev, fbha.getHeap4bytes(item))
+			}
+			return
+		}
+		prev, item = item, next
+	}
+}
+
+// removePointer removes the first occurrence of ptr from the list
+func removePointer(list []uint32, ptr uint32) []uint32 {
+	for i, p := range list {
+		if p == ptr {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
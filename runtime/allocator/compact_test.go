@@ -0,0 +1,152 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"testing"
+)
+
+// test that compacting lowers the bumper below the free blocks at the top of the heap
+func TestShouldCompactFreeTop(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blocks at header offsets 0, 16, 40, 56 and 128
+	ptrs, err := fbha.AllocateBatch([]uint32{8, 16, 8, 50, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is free yet
+	if reclaimed := fbha.Compact(); reclaimed != 0 || fbha.bumper != 144 {
+		t.Errorf("Fail: got reclaimed %d bumper %d expected 0 144", reclaimed, fbha.bumper)
+	}
+
+	// free everything but the first block
+	for _, i := range []int{1, 2, 3, 4} {
+		err = fbha.Deallocate(ptrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reclaimed := fbha.Compact()
+	if reclaimed != 128 {
+		t.Errorf("Fail: got reclaimed %d expected 128", reclaimed)
+	}
+	compareState(fbha, allocatorState{bumper: 16, totalSize: 16}, nil, nil, t)
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reclaimed space is bumped again
+	ptr, err := fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 24 {
+		t.Errorf("Fail: got %d expected 24", ptr)
+	}
+}
+
+// test that compacting only removes the blocks above the last live one from the middle of a free list
+func TestShouldCompactAboveLiveBlock(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs, err := fbha.AllocateBatch([]uint32{8, 8, 8, 8, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the free list becomes 64 -> 16 -> 48, with the live block at 32 in between
+	for _, i := range []int{3, 1, 4} {
+		err = fbha.Deallocate(ptrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reclaimed := fbha.Compact()
+	if reclaimed != 32 {
+		t.Errorf("Fail: got reclaimed %d expected 32", reclaimed)
+	}
+	compareState(fbha, allocatorState{bumper: 48, heads: map[int]uint32{0: 16}, totalSize: 32}, nil, nil, t)
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that freed large regions and side metadata blocks are compacted as well
+func TestShouldCompactLargeAndSideMetadata(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, twentyMiB+2*pageSize)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := fbha.Allocate(twentyMiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed := fbha.Compact(); reclaimed != twentyMiB+8 || len(fbha.freeLargeObjects[twentyMiB]) != 0 {
+		t.Errorf("Fail: got reclaimed %d with %d free regions", reclaimed, len(fbha.freeLargeObjects[twentyMiB]))
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	side := newSideMetadataAllocator(t, 0)
+	ptrs, err := side.AllocateBatch([]uint32{8, 8, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ptr := range ptrs[1:] {
+		err = side.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reclaimed := side.Compact(); reclaimed != 16 || len(side.freeBlocks[0]) != 0 {
+		t.Errorf("Fail: got reclaimed %d with %d free blocks", reclaimed, len(side.freeBlocks[0]))
+	}
+	err = side.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
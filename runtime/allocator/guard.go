@@ -0,0 +1,56 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+)
+
+// marker filling the guard bytes after the requested size of an allocation
+const guardMarker uint8 = 253
+
+// ErrBufferOverflow is returned when deallocating a pointer whose guard bytes were overwritten
+var ErrBufferOverflow = errors.New("allocation guard bytes overwritten")
+
+// With AllocatorConfig.GuardSize set, every allocation is made GuardSize bytes larger and the bytes
+// right after the requested size are filled with the guard marker. The requested size is recorded by
+// pointer, so deallocating can check that the guard is intact and report an overrun of the payload.
+
+// setGuard fills the guard bytes after size bytes of the allocation at pointer and records its size
+func (fbha *FreeingBumpHeapAllocator) setGuard(pointer, size uint32) {
+	guard := fbha.heap.Data()[pointer+size : pointer+size+fbha.guardSize]
+	for i := range guard {
+		guard[i] = guardMarker
+	}
+	fbha.guards[pointer] = size
+}
+
+// checkGuard returns ErrBufferOverflow if the guard bytes of the allocation at pointer were overwritten
+func (fbha *FreeingBumpHeapAllocator) checkGuard(pointer uint32) error {
+	size, ok := fbha.guards[pointer]
+	if !ok {
+		return nil
+	}
+	guard := fbha.heap.Data()[pointer+size : pointer+size+fbha.guardSize]
+	for i, b := range guard {
+		if b != guardMarker {
+			return fmt.Errorf("pointer %d: guard byte %d after %d bytes: %w", pointer, i, size, ErrBufferOverflow)
+		}
+	}
+	return nil
+}
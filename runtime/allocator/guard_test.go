@@ -0,0 +1,149 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+// utility function to create an allocator adding guard bytes to every allocation
+func newGuardedAllocator(t *testing.T, guardSize uint32) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{GuardSize: guardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fbha
+}
+
+// test that writing past the requested size of an allocation is detected when freeing it
+func TestShouldDetectBufferOverflow(t *testing.T) {
+	fbha := newGuardedAllocator(t, 4)
+
+	ptr, capacity, err := fbha.AllocateSized(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 bytes and the guard round up to the 16 byte bucket
+	if capacity != 12 || fbha.TotalSize != 24 {
+		t.Errorf("Fail: got capacity %d total size %d expected 12 24", capacity, fbha.TotalSize)
+	}
+	other, err := fbha.Allocate(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := fbha.heap.Data()
+	for i := uint32(0); i < 10; i++ {
+		data[other+i] = 0xff
+	}
+	err = fbha.Deallocate(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one byte too many
+	for i := uint32(0); i <= 10; i++ {
+		data[ptr+i] = 0xff
+	}
+	freed, err := fbha.DeallocateSized(ptr)
+	if !errors.Is(err, ErrBufferOverflow) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBufferOverflow)
+	}
+	// the block is freed all the same
+	if freed != 24 || fbha.TotalSize != 0 {
+		t.Errorf("Fail: got freed %d total size %d expected 24 0", freed, fbha.TotalSize)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that reallocating moves the guard after the new size, and refuses a block that overflowed
+func TestShouldReallocWithGuard(t *testing.T) {
+	fbha := newGuardedAllocator(t, 8)
+
+	ptr, err := fbha.Allocate(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shrinking in place, the old guard bytes become writable
+	ptr, err = fbha.Realloc(ptr, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fbha.heap.Data()
+	for i := uint32(0); i < 10; i++ {
+		data[ptr+i] = byte(i)
+	}
+
+	// growing past the bucket moves the payload
+	moved, err := fbha.Realloc(ptr, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == ptr {
+		t.Fatal("Fail: expected the allocation to move")
+	}
+	data = fbha.heap.Data()
+	for i := uint32(0); i < 10; i++ {
+		if data[moved+i] != byte(i) {
+			t.Errorf("Fail: byte %d got %d expected %d", i, data[moved+i], i)
+		}
+	}
+
+	data[moved+30] = 0
+	_, err = fbha.Realloc(moved, 100)
+	if !errors.Is(err, ErrBufferOverflow) {
+		t.Errorf("Fail: got %v expected %v", err, ErrBufferOverflow)
+	}
+}
+
+// test that guard bytes are only added when configured
+func TestShouldNotGuardByDefault(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.TotalSize != 16 || len(fbha.guards) != 0 {
+		t.Errorf("Fail: got total size %d with %d guards expected 16 0", fbha.TotalSize, len(fbha.guards))
+	}
+	// writing the whole bucket is fine without guard bytes
+	data := fbha.heap.Data()
+	for i := uint32(0); i < 8; i++ {
+		data[ptr+i] = 0xff
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+)
+
+// AllocatorConfig.OnAllocate and OnDeallocate are called with the pointer and the rounded bucket size of
+// each block once it's allocated or deallocated, e.g. to feed an external memory tracer. The size is the
+// requested size rounded up to its power of two bucket, or to whole pages for large allocations, with any
+// guard bytes. Both hooks are called after the lock is released, so a hook can call back into the allocator.
+// Realloc reports a moved allocation as a new block and a deallocated old one, and nothing when resizing in
+// place. Blocks discarded by Reset, FreeAll or Restore aren't reported, and neither are the no-op
+// deallocations of arena mode. Without hooks, no sizes are looked up.
+
+// hookSize returns the bucket size of the live block at pointer for a hook, or 0 if it can't be
+// determined. Must be called with the lock held.
+func (fbha *FreeingBumpHeapAllocator) hookSize(pointer uint32) uint32 {
+	size, err := fbha.payloadSize(pointer)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// notifyDeallocate calls the OnDeallocate hook, if set, for the block of bucket size that was at pointer, unless
+// deallocating failed. A guard overrun is still reported, as the block is freed.
+func (fbha *FreeingBumpHeapAllocator) notifyDeallocate(pointer, bucket uint32, err error) {
+	if fbha.onDeallocate == nil || bucket == 0 {
+		return
+	}
+	if err != nil && !errors.Is(err, ErrBufferOverflow) {
+		return
+	}
+	fbha.onDeallocate(pointer, bucket)
+}
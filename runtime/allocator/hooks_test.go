@@ -0,0 +1,208 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+// hookCall is an invocation of an allocation hook recorded by a test
+type hookCall struct {
+	dealloc bool
+	ptr     uint32
+	size    uint32
+}
+
+// utility function to create an allocator recording the calls of both hooks into calls
+func newHookedAllocator(t *testing.T, calls *[]hookCall) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{
+		OnAllocate: func(ptr, size uint32) {
+			*calls = append(*calls, hookCall{false, ptr, size})
+		},
+		OnDeallocate: func(ptr, size uint32) {
+			*calls = append(*calls, hookCall{true, ptr, size})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fbha
+}
+
+// test that the hooks are called with the pointer and bucket size of every block allocated and deallocated
+func TestShouldCallAllocationHooks(t *testing.T) {
+	var calls []hookCall
+	fbha := newHookedAllocator(t, &calls)
+
+	ptr, err := fbha.Allocate(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptrs, err := fbha.AllocateBatch([]uint32{1, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = fbha.AllocateSized(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fits the 16 byte bucket, so it's resized in place and not reported
+	_, err = fbha.Realloc(ptr, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := fbha.Realloc(ptr, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.DeallocateSized(ptrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []hookCall{
+		{false, 8, 16},
+		{false, 32, 8},
+		{false, 48, 128},
+		{false, 184, 32},
+		{false, 224, 32},
+		{true, 8, 16},
+		{true, 32, 8},
+		{true, 48, 128},
+	}
+	if moved != 224 {
+		t.Errorf("Fail: got %d expected 224", moved)
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Fail: got %v expected %v", calls, expected)
+	}
+}
+
+// test that failed operations and the no-op deallocations of arena mode aren't reported
+func TestShouldNotCallHooksOnFailure(t *testing.T) {
+	var calls []hookCall
+	fbha := newHookedAllocator(t, &calls)
+
+	_, err := fbha.Allocate(fbha.maxHeapSize)
+	if err == nil {
+		t.Error("Fail: expected an error allocating the whole heap")
+	}
+	err = fbha.Deallocate(16)
+	if err == nil {
+		t.Error("Fail: expected an error deallocating an invalid pointer")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Fail: got %v expected no calls", calls)
+	}
+
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deallocs := 0
+	arena, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{
+		ArenaMode:    true,
+		OnDeallocate: func(ptr, size uint32) { deallocs++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := arena.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = arena.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deallocs != 0 {
+		t.Errorf("Fail: got %d expected 0 calls", deallocs)
+	}
+}
+
+// test that a hook can call back into the allocator, so it must be called without the lock
+func TestShouldCallHooksWithoutLock(t *testing.T) {
+	var fbha *FreeingBumpHeapAllocator
+	var totalSizes []uint32
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err = NewAllocatorWithConfig(mem, 0, AllocatorConfig{
+		OnAllocate: func(ptr, size uint32) {
+			totalSizes = append(totalSizes, fbha.Stats().TotalSize)
+		},
+		OnDeallocate: func(ptr, size uint32) {
+			totalSizes = append(totalSizes, fbha.Stats().TotalSize)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(totalSizes, []uint32{16, 0}) {
+		t.Errorf("Fail: got %v expected [16 0]", totalSizes)
+	}
+}
+
+// test that a nil hook is skipped while the other one is still called
+func TestShouldSkipNilHook(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocs []uint32
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{
+		OnAllocate: func(ptr, size uint32) { allocs = append(allocs, ptr) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := fbha.Realloc(ptr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(allocs, []uint32{ptr, moved}) {
+		t.Errorf("Fail: got %v expected [%d %d]", allocs, ptr, moved)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"fmt"
+)
+
+// Allocations above MaxPossibleAllocation bypass the power of two free lists. They are bumped
+// as a contiguous region rounded up to a whole number of pages and tracked in a side map from
+// heap offset to region size. The region keeps a header like small blocks, so a pointer is never 0,
+// but its list index byte is out of range and only the side map is trusted. A freed
+// region is kept aside and reused by the next large allocation of the same rounded size.
+// In side metadata mode the region has no header, the pointer offset already keeps it nonzero.
+//
+// AllocatePageAligned serves any size as such a region, with padding bumped in front of it so the
+// pointer lands on a page boundary. The padding is recorded by region offset, it stays with the
+// region while it's freed and reused, and it's counted in TotalSize while the region is live.
+
+// allocateLarge allocates a region of at least size bytes
+func (fbha *FreeingBumpHeapAllocator) allocateLarge(size uint32) (uint32, error) {
+	regionSize, err := largeRegionSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+
+	err = fbha.ensureSpace(regionSize + fbha.headerSize())
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+
+	var ptr uint32
+	if free := fbha.freeLargeObjects[regionSize]; !fbha.arenaMode && len(free) > 0 {
+		ptr = free[len(free)-1]
+		fbha.freeLargeObjects[regionSize] = free[:len(free)-1]
+	} else {
+		ptr, err = fbha.bump(regionSize + fbha.headerSize())
+		if err != nil {
+			return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+		}
+		ptr += fbha.headerSize()
+	}
+
+	return fbha.claimLarge(ptr, regionSize), nil
+}
+
+// AllocatePageAligned allocates at least size bytes at a pointer aligned to a wasm page, e.g. for buffers accessed
+// as whole pages. The allocation is rounded up to whole pages and up to a page of padding may be bumped in front
+// of it. The pointer is deallocated like any other, which reclaims the padding as well.
+func (fbha *FreeingBumpHeapAllocator) AllocatePageAligned(size uint32) (ptr uint32, err error) {
+	fbha.lock.Lock()
+	var bucket uint32
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		if err == nil && fbha.onAllocate != nil {
+			fbha.onAllocate(ptr, bucket)
+		}
+		notify()
+	}()
+
+	ptr, err = fbha.allocatePageAligned(size)
+	if err == nil && fbha.onAllocate != nil {
+		bucket = fbha.hookSize(ptr)
+	}
+	return ptr, err
+}
+
+// allocatePageAligned is the counterpart of allocate for AllocatePageAligned
+func (fbha *FreeingBumpHeapAllocator) allocatePageAligned(size uint32) (uint32, error) {
+	if err := fbha.checkCallBudget(size); err != nil {
+		return 0, err
+	}
+
+	ptr, err := fbha.allocateAlignedRegion(size)
+	if err == nil && fbha.trackLeaks {
+		fbha.recordAllocation(ptr, size)
+	}
+	if err == nil {
+		fbha.chargeCall(size)
+	}
+	fbha.updatePeak()
+	return ptr, err
+}
+
+func (fbha *FreeingBumpHeapAllocator) allocateAlignedRegion(size uint32) (uint32, error) {
+	if size == 0 {
+		size = 1
+	}
+	regionSize, err := largeRegionSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+
+	// any freed region of the size that is already aligned can be reused
+	if free := fbha.freeLargeObjects[regionSize]; !fbha.arenaMode {
+		for i := len(free) - 1; i >= 0; i-- {
+			if (fbha.ptrOffset+free[i])%pageSize == 0 {
+				ptr := free[i]
+				fbha.freeLargeObjects[regionSize] = append(free[:i], free[i+1:]...)
+				return fbha.claimLarge(ptr, regionSize), nil
+			}
+		}
+	}
+
+	ptr := fbha.alignedRegion(fbha.bumper)
+	padding := ptr - fbha.headerSize() - fbha.bumper
+	err = fbha.ensureSpace(padding + regionSize + fbha.headerSize())
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+	_, err = fbha.bump(padding + regionSize + fbha.headerSize())
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate %d bytes: %w", size, err)
+	}
+	if padding != 0 {
+		fbha.pagePadding[ptr] = padding
+	}
+
+	return fbha.claimLarge(ptr, regionSize), nil
+}
+
+// alignedRegion returns the first page aligned region offset that leaves room for a header after heap offset block
+func (fbha *FreeingBumpHeapAllocator) alignedRegion(block uint32) uint32 {
+	absolute := uint64(fbha.ptrOffset) + uint64(block) + uint64(fbha.headerSize())
+	return uint32((absolute+pageSize-1)/pageSize*pageSize) - fbha.ptrOffset
+}
+
+// blockPadding returns the padding bumped at heap offset block in front of a page aligned region, or 0. The region
+// can only start at the first aligned offset after block, so that's the only one to look up.
+func (fbha *FreeingBumpHeapAllocator) blockPadding(block uint32) uint32 {
+	ptr := fbha.alignedRegion(block)
+	if padding, ok := fbha.pagePadding[ptr]; ok && ptr-fbha.headerSize()-padding == block {
+		return padding
+	}
+	return 0
+}
+
+// claimLarge marks the region at heap offset ptr as a live large object and returns its pointer
+func (fbha *FreeingBumpHeapAllocator) claimLarge(ptr, regionSize uint32) uint32 {
+	if !fbha.sideMetadata {
+		for i := uint32(1); i <= 8; i++ {
+			fbha.setHeap(ptr-i, liveMarker)
+		}
+	}
+	if fbha.zeroOnAlloc {
+		fbha.zero(ptr, regionSize)
+	}
+	fbha.largeObjects[ptr] = regionSize
+	fbha.TotalSize = fbha.TotalSize + fbha.pagePadding[ptr] + regionSize + fbha.headerSize()
+	fbha.logger.Debug("[allocateLarge]", "size", regionSize, "heap_size after allocation", fbha.TotalSize)
+	return fbha.ptrOffset + ptr
+}
+
+// largeRegionSize rounds size up to a whole number of pages
+func largeRegionSize(size uint32) (uint32, error) {
+	rounded := (uint64(size) + pageSize - 1) / pageSize * pageSize
+	if rounded > uint64(^uint32(0)) {
+		return 0, ErrSizeTooLarge
+	}
+	return uint32(rounded), nil
+}
+
+// deallocateLarge frees the live large region at heap offset ptr
+func (fbha *FreeingBumpHeapAllocator) deallocateLarge(ptr uint32) error {
+	regionSize := fbha.largeObjects[ptr]
+	delete(fbha.largeObjects, ptr)
+	fbha.freeLargeObjects[regionSize] = append(fbha.freeLargeObjects[regionSize], ptr)
+	if fbha.scrubOnFree {
+		fbha.zero(ptr, regionSize)
+	}
+
+	fbha.TotalSize = fbha.TotalSize - fbha.pagePadding[ptr] - regionSize - fbha.headerSize()
+	fbha.logger.Debug("[deallocateLarge]", "size", regionSize, "heap total_size after Deallocate", fbha.TotalSize)
+	return nil
+}
+
+// freedLargeSize returns the region size if heap offset ptr is a freed large region
+func (fbha *FreeingBumpHeapAllocator) freedLargeSize(ptr uint32) (uint32, bool) {
+	for size, free := range fbha.freeLargeObjects {
+		for _, p := range free {
+			if p == ptr {
+				return size, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,300 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	wasm "github.com/wasmerio/go-ext-wasm/wasmer"
+)
+
+const twentyMiB = 20 * 1024 * 1024
+
+// utility function to create a wasm.Memory of at least size bytes that doesn't share its data with mem, so
+// relocating from mem to it really changes the memory
+func newSeparateWasmMemory(t *testing.T, mem *wasm.Memory, size uint32) *wasm.Memory {
+	separate := newWasmMemoryOfSize(t, size)
+	if &separate.Data()[0] == &mem.Data()[0] {
+		t.Fatal("Fail: new memory shares its data with the old one")
+	}
+	if separate.Length() <= mem.Length() {
+		t.Fatalf("Fail: got memory of %d bytes expected more than %d", separate.Length(), mem.Length())
+	}
+	return separate
+}
+
+// utility function to create a wasm.Memory of at least size bytes
+func newWasmMemoryOfSize(t *testing.T, size uint32) *wasm.Memory {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem.Length() < size {
+		err = mem.Grow((size-mem.Length())/pageSize + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mem
+}
+
+// test that an allocation above MaxPossibleAllocation is bumped as a page rounded region
+//  and reclaimed on free
+func TestShouldAllocateAndFreeLargeObject(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, 2*twentyMiB)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := fbha.Allocate(twentyMiB + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != 8 {
+		t.Errorf("Fail: got %d expected 8", ptr)
+	}
+
+	expectedSize := uint32(twentyMiB + pageSize + 8)
+	if fbha.TotalSize != expectedSize || fbha.bumper != expectedSize {
+		t.Errorf("Fail: got total size %d bumper %d expected %d", fbha.TotalSize, fbha.bumper, expectedSize)
+	}
+	if !reflect.DeepEqual(fbha.heads, emptyHeads(HeadsQty)) {
+		t.Errorf("Fail: free lists changed by a large allocation %v", fbha.heads)
+	}
+
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.TotalSize != 0 {
+		t.Errorf("Fail: got total size %d expected 0", fbha.TotalSize)
+	}
+
+	err = fbha.Deallocate(ptr)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+
+	// a region of the same rounded size is reused
+	reused, err := fbha.Allocate(twentyMiB + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != ptr {
+		t.Errorf("Fail: got %d expected %d", reused, ptr)
+	}
+	if fbha.bumper != expectedSize {
+		t.Errorf("Fail: got bumper %d expected %d", fbha.bumper, expectedSize)
+	}
+}
+
+// test that large and small allocations can be interleaved without affecting each other
+func TestShouldInterleaveLargeAndSmallAllocations(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, 2*twentyMiB+pageSize)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small1, err := fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := fbha.Allocate(twentyMiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small2, err := fbha.Allocate(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if small1 != 8 || large != 24 || small2 != 24+twentyMiB+8 {
+		t.Errorf("Fail: got pointers %d %d %d", small1, large, small2)
+	}
+
+	err = fbha.Deallocate(small2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.TotalSize != 16 {
+		t.Errorf("Fail: got total size %d expected 16", fbha.TotalSize)
+	}
+
+	// the small block goes back through its free list
+	reused, err := fbha.Allocate(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != small2 {
+		t.Errorf("Fail: got %d expected %d", reused, small2)
+	}
+}
+
+// test that page aligned allocations land on page boundaries and that freeing them reclaims the padding
+func TestShouldAllocatePageAligned(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, 8*pageSize)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small, err := fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned1, err := fbha.AllocatePageAligned(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned2, err := fbha.AllocatePageAligned(pageSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aligned1 != pageSize || aligned2 != 3*pageSize {
+		t.Errorf("Fail: got pointers %d %d expected %d %d", aligned1, aligned2, pageSize, 3*pageSize)
+	}
+	// the padding, header and region of each aligned allocation span everything up to the end of the region
+	if fbha.TotalSize != 5*pageSize || fbha.bumper != 5*pageSize {
+		t.Errorf("Fail: got total size %d bumper %d expected %d", fbha.TotalSize, fbha.bumper, 5*pageSize)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ptr := range []uint32{aligned1, aligned2} {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fbha.TotalSize != 136 {
+		t.Errorf("Fail: got total size %d expected 136", fbha.TotalSize)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the freed region is reused with its padding
+	reused, err := fbha.AllocatePageAligned(pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != aligned1 {
+		t.Errorf("Fail: got %d expected %d", reused, aligned1)
+	}
+	if fbha.TotalSize != 2*pageSize {
+		t.Errorf("Fail: got total size %d expected %d", fbha.TotalSize, 2*pageSize)
+	}
+
+	err = fbha.Deallocate(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that DeallocateSized counts the padding released along with a page aligned allocation
+func TestShouldReturnDeallocatedSizePageAligned(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, 8*pageSize)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned, err := fbha.AllocatePageAligned(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totalSize := fbha.TotalSize
+	freed, err := fbha.DeallocateSized(aligned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the padding and header fill the rest of the first page in front of the region
+	if freed != 2*pageSize-136 {
+		t.Errorf("Fail: got %d expected %d", freed, 2*pageSize-136)
+	}
+	if totalSize-fbha.TotalSize != freed {
+		t.Errorf("Fail: got total size drop %d expected %d", totalSize-fbha.TotalSize, freed)
+	}
+}
+
+// test that Snapshot and Restore walk over the padding of page aligned allocations
+func TestShouldSnapshotPageAligned(t *testing.T) {
+	mem := newWasmMemoryOfSize(t, 8*pageSize)
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned, err := fbha.AllocatePageAligned(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := fbha.Snapshot()
+	checksum := fbha.HeaderChecksum()
+
+	for _, ptr := range []uint32{aligned, after} {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fbha.Restore(snapshot)
+
+	err = fbha.CheckHeaderChecksum(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ptr := range []uint32{aligned, after} {
+		err = fbha.Deallocate(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	goruntime "runtime"
+	"sort"
+)
+
+// maximum number of frames captured for a tracked allocation
+const maxLeakFrames = 32
+
+// LeakRecord describes a live allocation recorded while tracking leaks
+type LeakRecord struct {
+	Pointer uint32
+	Size    uint32 // requested size, not the block size
+	// program counters of the call stack that allocated, starting at the caller of the
+	// allocator, which can be resolved with runtime.CallersFrames
+	Stack []uintptr
+}
+
+// Leaks returns a record for every allocation that is still live, sorted by pointer. Allocations
+// are only recorded if the allocator was created with AllocatorConfig.TrackLeaks.
+func (fbha *FreeingBumpHeapAllocator) Leaks() []LeakRecord {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	leaks := make([]LeakRecord, 0, len(fbha.leaks))
+	for _, record := range fbha.leaks {
+		leaks = append(leaks, record)
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].Pointer < leaks[j].Pointer
+	})
+	return leaks
+}
+
+// recordAllocation captures the call stack of the allocation at pointer, it must be called from allocate or allocatePageAligned
+func (fbha *FreeingBumpHeapAllocator) recordAllocation(pointer, size uint32) {
+	// skip Callers, recordAllocation, allocate and the exported allocator method
+	pcs := make([]uintptr, maxLeakFrames)
+	n := goruntime.Callers(4, pcs)
+	fbha.leaks[pointer] = LeakRecord{
+		Pointer: pointer,
+		Size:    size,
+		Stack:   pcs[:n],
+	}
+}
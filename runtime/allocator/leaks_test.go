@@ -0,0 +1,119 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	goruntime "runtime"
+	"strings"
+	"testing"
+)
+
+// test that live allocations are reported with their size and call stack
+func TestShouldTrackLeaks(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{TrackLeaks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ptrs []uint32
+	for _, size := range []uint32{1, 42, 100} {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+
+	leaks := fbha.Leaks()
+	if len(leaks) != 3 {
+		t.Fatalf("Fail: got %d leaks expected %d", len(leaks), 3)
+	}
+	if leaks[1].Pointer != ptrs[1] || leaks[1].Size != 42 {
+		t.Errorf("Fail: got %v expected pointer %d of size %d", leaks[1], ptrs[1], 42)
+	}
+
+	// the stack starts at the caller of Allocate
+	frame, _ := goruntime.CallersFrames(leaks[1].Stack).Next()
+	if !strings.HasSuffix(frame.Function, "TestShouldTrackLeaks") {
+		t.Errorf("Fail: got caller %s expected TestShouldTrackLeaks", frame.Function)
+	}
+
+	// freeing clears the record
+	err = fbha.Deallocate(ptrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaks = fbha.Leaks()
+	if len(leaks) != 2 {
+		t.Fatalf("Fail: got %d leaks expected %d", len(leaks), 2)
+	}
+	for _, leak := range leaks {
+		if leak.Pointer == ptrs[1] {
+			t.Errorf("Fail: expected %d to be freed", ptrs[1])
+		}
+	}
+
+	// a moved allocation is tracked at its new pointer
+	moved, err := fbha.Realloc(ptrs[0], 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaks = fbha.Leaks()
+	if len(leaks) != 2 || leaks[1].Pointer != moved || leaks[1].Size != 500 {
+		t.Errorf("Fail: got %v expected pointer %d of size %d", leaks, moved, 500)
+	}
+
+	// Restore brings back the records of the snapshot
+	snapshot := fbha.Snapshot()
+	_, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha.Restore(snapshot)
+	if len(fbha.Leaks()) != 2 {
+		t.Errorf("Fail: got %d leaks after Restore expected %d", len(fbha.Leaks()), 2)
+	}
+
+	fbha.FreeAll()
+	if len(fbha.Leaks()) != 0 {
+		t.Errorf("Fail: expected no leaks after FreeAll, got %v", fbha.Leaks())
+	}
+}
+
+// test that allocations aren't recorded unless tracking is enabled
+func TestShouldNotTrackLeaksByDefault(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fbha.Leaks()) != 0 {
+		t.Errorf("Fail: got %v expected no leaks", fbha.Leaks())
+	}
+}
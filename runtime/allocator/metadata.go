@@ -0,0 +1,111 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"fmt"
+)
+
+// In side metadata mode small blocks have no header in the heap, a block is just its power of two
+// bucket, and the list index and free state of each block are kept in a side map indexed by the
+// heap offset of the payload. The free lists are kept beside it as well, since a link can't be
+// stored in a block without a header. The heap offset 0 is then a valid block, so the pointer
+// offset is moved past it to keep the pointers handed out nonzero.
+
+// blockMetadata is the header of a small block in side metadata mode
+type blockMetadata struct {
+	listIndex uint8
+	freed     bool
+}
+
+// headerSize returns the number of bytes bumped in front of every block for its header
+func (fbha *FreeingBumpHeapAllocator) headerSize() uint32 {
+	if fbha.sideMetadata {
+		return 0
+	}
+	return fbha.alignment
+}
+
+// allocateSide takes a block of itemSize bytes from its free list, or bumps one, and records its metadata
+func (fbha *FreeingBumpHeapAllocator) allocateSide(listIndex int, itemSize uint32) (uint32, error) {
+	var ptr uint32
+	if free := fbha.freeBlocks[listIndex]; len(free) > 0 {
+		ptr = free[len(free)-1]
+		fbha.freeBlocks[listIndex] = free[:len(free)-1]
+	} else {
+		var err error
+		ptr, err = fbha.bump(itemSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+	fbha.metadata[ptr] = blockMetadata{listIndex: uint8(listIndex)}
+	return ptr, nil
+}
+
+// deallocateSide marks the live block at heap offset ptr as freed and pushes it on its free list
+func (fbha *FreeingBumpHeapAllocator) deallocateSide(ptr uint32) uint8 {
+	meta := fbha.metadata[ptr]
+	meta.freed = true
+	fbha.metadata[ptr] = meta
+	fbha.freeBlocks[meta.listIndex] = append(fbha.freeBlocks[meta.listIndex], ptr)
+	return meta.listIndex
+}
+
+// sidePayloadSize is payloadSize for the small blocks in side metadata mode
+func (fbha *FreeingBumpHeapAllocator) sidePayloadSize(pointer uint32) (uint32, error) {
+	ptr := pointer - fbha.ptrOffset
+	meta, ok := fbha.metadata[ptr]
+	if !ok {
+		if _, ok := fbha.freedLargeSize(ptr); ok {
+			return 0, fmt.Errorf("pointer %d: %w", pointer, ErrDoubleFree)
+		}
+		return 0, fmt.Errorf("pointer %d was not allocated: %w", pointer, ErrInvalidPointer)
+	}
+	if meta.freed {
+		return 0, fmt.Errorf("pointer %d: %w", pointer, ErrDoubleFree)
+	}
+	return uint32(getItemSizeFromIndex(uint(meta.listIndex))), nil
+}
+
+// sideFreeSize checks the free lists in side metadata mode like Verify, returning the size of the free blocks
+func (fbha *FreeingBumpHeapAllocator) sideFreeSize() (uint32, error) {
+	var freeSize uint32
+	visited := make(map[uint32]bool)
+	for i, free := range fbha.freeBlocks {
+		for _, ptr := range free {
+			itemSize := uint32(getItemSizeFromIndex(uint(i)))
+			if ptr+itemSize > fbha.bumper {
+				return 0, fmt.Errorf("free list %d: block %d is past the bumper %d", i, ptr, fbha.bumper)
+			}
+			if visited[ptr] {
+				return 0, fmt.Errorf("free list %d: block %d is linked twice", i, ptr)
+			}
+			visited[ptr] = true
+
+			meta, ok := fbha.metadata[ptr]
+			if !ok || !meta.freed {
+				return 0, fmt.Errorf("free list %d: block %d isn't marked freed", i, ptr)
+			}
+			if int(meta.listIndex) != i {
+				return 0, fmt.Errorf("free list %d: block %d has list index %d", i, ptr, meta.listIndex)
+			}
+			freeSize += itemSize
+		}
+	}
+	return freeSize, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+// utility function to create an allocator keeping its block metadata outside of the heap
+func newSideMetadataAllocator(t *testing.T, ptrOffset uint32) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, ptrOffset, AllocatorConfig{SideMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fbha
+}
+
+// test that in side metadata mode the blocks are bumped back to back without headers, so the
+//  payload of each block occupies its whole bucket
+func TestSideMetadataPayloadOccupiesBucket(t *testing.T) {
+	fbha := newSideMetadataAllocator(t, 16)
+
+	sizes := []uint32{8, 1, 16, 32}
+	expected := []uint32{16, 24, 32, 48}
+	for i, size := range sizes {
+		ptr, capacity, err := fbha.AllocateSized(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ptr != expected[i] {
+			t.Errorf("Fail: got %v expected %v", ptr, expected[i])
+		}
+		if capacity != nextPowerOf2GT8(size) {
+			t.Errorf("Fail: got %v expected %v", capacity, nextPowerOf2GT8(size))
+		}
+	}
+
+	compareState(fbha, allocatorState{bumper: 64, ptrOffset: 16, totalSize: 64}, nil, nil, t)
+
+	// a payload filling its bucket doesn't reach into the metadata of the next block
+	data := fbha.heap.Data()
+	for i := uint32(16); i < 24; i++ {
+		data[i] = 0xff
+	}
+	if capacity, err := fbha.payloadSize(24); err != nil || capacity != 8 {
+		t.Errorf("Fail: got %v %v expected 8", capacity, err)
+	}
+}
+
+// test that blocks allocated in side metadata mode are freed onto their list and reused
+func TestSideMetadataAllocateDeallocate(t *testing.T) {
+	fbha := newSideMetadataAllocator(t, 0)
+
+	// the first block would be at offset 0, so the pointer offset moves past it
+	if fbha.ptrOffset != defaultAlignment {
+		t.Errorf("Fail: got %v expected %v", fbha.ptrOffset, defaultAlignment)
+	}
+
+	ptr1, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr2, err := fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr1 != 8 || ptr2 != 16 {
+		t.Errorf("Fail: got %v %v expected 8 16", ptr1, ptr2)
+	}
+
+	err = fbha.Deallocate(ptr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareState(fbha, allocatorState{bumper: 16, ptrOffset: 8, totalSize: 0}, nil, nil, t)
+
+	if stats := fbha.Stats(); stats.FreeBlocks[0] != 2 {
+		t.Errorf("Fail: got %v expected 2", stats.FreeBlocks[0])
+	}
+	if !fbha.PreferFreeList(0) {
+		t.Error("Fail: expected the free list to hold blocks")
+	}
+	if err = fbha.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fbha.Deallocate(ptr1)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Fail: got %v expected %v", err, ErrDoubleFree)
+	}
+	err = fbha.Deallocate(ptr1 + 4)
+	if !errors.Is(err, ErrInvalidPointer) {
+		t.Errorf("Fail: got %v expected %v", err, ErrInvalidPointer)
+	}
+
+	// the last freed block is reused first, like the inline free lists
+	ptr, err := fbha.Allocate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != ptr2 {
+		t.Errorf("Fail: got %v expected %v", ptr, ptr2)
+	}
+	ptr, err = fbha.Allocate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != ptr1 {
+		t.Errorf("Fail: got %v expected %v", ptr, ptr1)
+	}
+	compareState(fbha, allocatorState{bumper: 16, ptrOffset: 8, totalSize: 16}, nil, nil, t)
+	if err = fbha.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that Snapshot and Restore roll back the side metadata
+func TestSideMetadataSnapshotRestore(t *testing.T) {
+	fbha := newSideMetadataAllocator(t, 0)
+
+	ptr, err := fbha.Allocate(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := fbha.Snapshot()
+
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbha.Restore(snapshot)
+	compareState(fbha, allocatorState{bumper: 16, ptrOffset: 8, totalSize: 16}, nil, nil, t)
+	if err = fbha.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block is live again, so it can be freed once more
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
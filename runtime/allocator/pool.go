@@ -0,0 +1,67 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+
+	wasm "github.com/wasmerio/go-ext-wasm/wasmer"
+)
+
+// ErrTooManySubHeaps is returned when the memory is too small to be divided into the requested number of sub-heaps
+var ErrTooManySubHeaps = errors.New("memory too small for the number of sub-heaps")
+
+// the smallest sub-heap holds a single block of the smallest bucket and its header
+const minSubHeapSize = 2 * defaultAlignment
+
+// NewAllocatorPool divides the memory from ptrOffset on into count sub-heaps of equal size, each served by
+//   its own FreeingBumpHeapAllocator, so that concurrent runtime calls sharing one memory can't collide. The
+//   sub-heaps are contiguous and in order, each allocator's pointer offset is the end of the previous
+//   sub-heap and its maximum heap size is bounded by the start of the next one, so they can't grow.
+//   ErrTooManySubHeaps is returned if a sub-heap couldn't hold a single block.
+func NewAllocatorPool(mem *wasm.Memory, ptrOffset uint32, count int) ([]*FreeingBumpHeapAllocator, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("cannot divide memory into %d sub-heaps", count)
+	}
+
+	padding := ptrOffset % defaultAlignment
+	if padding != 0 {
+		ptrOffset += defaultAlignment - padding
+	}
+	currentSize := mem.Length()
+	if ptrOffset >= currentSize {
+		return nil, fmt.Errorf("pointer offset %d leaves no heap in %d bytes of memory", ptrOffset, currentSize)
+	}
+
+	// sub-heaps are a multiple of the alignment, so every pointer offset stays aligned
+	subHeapSize := (currentSize - ptrOffset) / uint32(count) / defaultAlignment * defaultAlignment
+	if subHeapSize < minSubHeapSize {
+		return nil, fmt.Errorf("%d sub-heaps in %d bytes: %w", count, currentSize-ptrOffset, ErrTooManySubHeaps)
+	}
+
+	pool := make([]*FreeingBumpHeapAllocator, count)
+	for i := range pool {
+		fbha, err := NewAllocator(mem, ptrOffset+uint32(i)*subHeapSize)
+		if err != nil {
+			return nil, err
+		}
+		fbha.maxHeapSize = subHeapSize
+		pool[i] = fbha
+	}
+	return pool, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+// test that the sub-heaps of a pool are contiguous and the allocations of one never overlap another's
+func TestShouldAllocateFromDisjointSubHeaps(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewAllocatorPool(mem, 13, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subHeapSize := (mem.Length() - 16) / 4 / 8 * 8
+	for i, fbha := range pool {
+		start := 16 + uint32(i)*subHeapSize
+		if fbha.ptrOffset != start || fbha.maxHeapSize != subHeapSize {
+			t.Errorf("Fail: got offset %d size %d expected %d %d", fbha.ptrOffset, fbha.maxHeapSize, start, subHeapSize)
+		}
+
+		// fill the sub-heap, every block has to end before the next sub-heap starts
+		for {
+			ptr, err := fbha.Allocate(pageSize)
+			if errors.Is(err, ErrOutOfSpace) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ptr < start || ptr+pageSize > start+subHeapSize {
+				t.Errorf("Fail: sub-heap %d allocated %d outside of [%d, %d)", i, ptr, start, start+subHeapSize)
+			}
+			data := mem.Data()
+			for j := uint32(0); j < pageSize; j++ {
+				data[ptr+j] = byte(i + 1)
+			}
+		}
+	}
+
+	// the blocks written above didn't overwrite the headers of another sub-heap
+	for i, fbha := range pool {
+		err = fbha.Verify()
+		if err != nil {
+			t.Errorf("Fail: sub-heap %d: %v", i, err)
+		}
+	}
+}
+
+// test that a freed block doesn't let the bumper run past the end of a sub-heap
+func TestShouldNotBumpPastSubHeap(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewAllocatorPool(mem, 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha := pool[0]
+
+	ptr, err := fbha.Allocate(2 * pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the total size is 0 again, but the bumper is past the freed block and the next bucket doesn't fit above it
+	_, err = fbha.Allocate(2*pageSize + 1)
+	if !errors.Is(err, ErrOutOfSpace) {
+		t.Errorf("Fail: got %v expected %v", err, ErrOutOfSpace)
+	}
+	if fbha.bumper != 2*pageSize+8 {
+		t.Errorf("Fail: got bumper %d expected %d", fbha.bumper, 2*pageSize+8)
+	}
+}
+
+// test that dividing the memory into more sub-heaps than it can hold is rejected
+func TestShouldRejectOverSubscribedPool(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewAllocatorPool(mem, 0, int(mem.Length()/minSubHeapSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewAllocatorPool(mem, 0, int(mem.Length()/minSubHeapSize)+1)
+	if !errors.Is(err, ErrTooManySubHeaps) {
+		t.Errorf("Fail: got %v expected %v", err, ErrTooManySubHeaps)
+	}
+	_, err = NewAllocatorPool(mem, 0, 0)
+	if err == nil {
+		t.Error("Fail: expected an error for no sub-heaps")
+	}
+	_, err = NewAllocatorPool(mem, mem.Length(), 1)
+	if err == nil {
+		t.Error("Fail: expected an error for an offset past the memory")
+	}
+}
+
+// test that relocating a sub-heap keeps it bounded, while the last one extends to the end of the new memory
+func TestShouldRelocateSubHeaps(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewAllocatorPool(mem, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subHeapSize := pool[0].maxHeapSize
+
+	larger := newSeparateWasmMemory(t, mem, mem.Length()+pageSize)
+	for _, fbha := range pool {
+		err = fbha.Relocate(larger)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pool[0].maxHeapSize != subHeapSize {
+		t.Errorf("Fail: got %d expected %d", pool[0].maxHeapSize, subHeapSize)
+	}
+	if pool[1].maxHeapSize != larger.Length()-subHeapSize {
+		t.Errorf("Fail: got %d expected %d", pool[1].maxHeapSize, larger.Length()-subHeapSize)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+// default thresholds of the memory pressure callbacks, in percent of the maximum heap size
+const (
+	defaultHighWaterPercent = 90
+	defaultLowWaterGap      = 10
+)
+
+// With AllocatorConfig.OnHighWater or OnLowWater set, the allocator tracks whether TotalSize is above the
+// high water mark. OnHighWater is called once when TotalSize reaches HighWaterPercent of the maximum heap size,
+// and not again until OnLowWater was called once it dropped below LowWaterPercent, so a heap hovering around
+// a single threshold doesn't flap. The callbacks are called with TotalSize and the maximum heap size after the
+// lock is released, so they can call back into the allocator. Without callbacks, nothing is tracked.
+
+// noPressureChange is returned by checkPressure when no callback is due
+func noPressureChange() {}
+
+// checkPressure updates the high water state for the current TotalSize and returns the callback that's due,
+// bound to its arguments, to be called once the lock is released. Must be called with the lock held.
+func (fbha *FreeingBumpHeapAllocator) checkPressure() func() {
+	if fbha.onHighWater == nil && fbha.onLowWater == nil {
+		return noPressureChange
+	}
+
+	total, max := fbha.TotalSize, fbha.maxHeapSize
+	used := uint64(total) * 100
+	switch {
+	case !fbha.aboveHighWater && used >= uint64(fbha.highWaterPercent)*uint64(max):
+		fbha.aboveHighWater = true
+		if fbha.onHighWater != nil {
+			return func() { fbha.onHighWater(total, max) }
+		}
+	case fbha.aboveHighWater && used < uint64(fbha.lowWaterPercent)*uint64(max):
+		fbha.aboveHighWater = false
+		if fbha.onLowWater != nil {
+			return func() { fbha.onLowWater(total, max) }
+		}
+	}
+	return noPressureChange
+}
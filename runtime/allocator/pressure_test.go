@@ -0,0 +1,132 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+// pressureCall is an invocation of a memory pressure callback recorded by a test
+type pressureCall struct {
+	high  bool
+	total uint32
+	max   uint32
+}
+
+// utility function to create an allocator with water marks at 50% and 25% of the heap, recording the calls of
+// both callbacks into calls
+func newPressureAllocator(t *testing.T, calls *[]pressureCall) *FreeingBumpHeapAllocator {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fbha *FreeingBumpHeapAllocator
+	fbha, err = NewAllocatorWithConfig(mem, 0, AllocatorConfig{
+		HighWaterPercent: 50,
+		LowWaterPercent:  25,
+		OnHighWater: func(total, max uint32) {
+			// the callbacks are called without the lock, so this doesn't deadlock
+			fbha.Stats()
+			*calls = append(*calls, pressureCall{true, total, max})
+		},
+		OnLowWater: func(total, max uint32) {
+			fbha.Stats()
+			*calls = append(*calls, pressureCall{false, total, max})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fbha
+}
+
+// test that each callback is called once per crossing of its water mark
+func TestShouldCallPressureCallbacksOncePerCrossing(t *testing.T) {
+	var calls []pressureCall
+	fbha := newPressureAllocator(t, &calls)
+	// on the 1 MiB test memory the water marks are at 524288 and 262144 bytes
+	max := fbha.maxHeapSize
+	if max != 16*pageSize {
+		t.Fatalf("Fail: got max heap size %d expected %d", max, 16*pageSize)
+	}
+	block := uint32(64*1024 + 8)
+
+	// 7 blocks stay below 50%, the 8th reaches it and later ones don't call again
+	var ptrs []uint32
+	for i := 0; i < 10; i++ {
+		ptr, err := fbha.Allocate(64 * 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	expected := []pressureCall{{true, 8 * block, max}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Fail: got %v expected %v", calls, expected)
+	}
+
+	// dropping below 50% isn't enough, below 25% is reached with 3 blocks left
+	for len(ptrs) > 2 {
+		err := fbha.Deallocate(ptrs[len(ptrs)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = ptrs[:len(ptrs)-1]
+	}
+	expected = append(expected, pressureCall{false, 3 * block, max})
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Fail: got %v expected %v", calls, expected)
+	}
+
+	// crossing again calls again, as does discarding everything
+	_, err := fbha.AllocateBatch([]uint32{64 * 1024, 64 * 1024, 64 * 1024, 64 * 1024, 64 * 1024, 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha.FreeAll()
+	expected = append(expected, pressureCall{true, 8 * block, max}, pressureCall{false, 0, max})
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Fail: got %v expected %v", calls, expected)
+	}
+}
+
+// test that invalid water marks are rejected
+func TestShouldRejectInvalidWaterMarks(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []AllocatorConfig{
+		{HighWaterPercent: 101},
+		{HighWaterPercent: 50, LowWaterPercent: 50},
+		{LowWaterPercent: 95},
+	} {
+		_, err = NewAllocatorWithConfig(mem, 0, cfg)
+		if err == nil {
+			t.Errorf("Fail: expected an error for water marks %d%% and %d%%", cfg.LowWaterPercent, cfg.HighWaterPercent)
+		}
+	}
+
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{HighWaterPercent: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha.highWaterPercent != 8 || fbha.lowWaterPercent != 4 {
+		t.Errorf("Fail: got water marks %d%% and %d%% expected 4%% and 8%%", fbha.lowWaterPercent, fbha.highWaterPercent)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+// AllocatorSnapshot holds the allocator state captured by Snapshot
+type AllocatorSnapshot struct {
+	bumper           uint32
+	heads            []uint32
+	totalSize        uint32
+	largeObjects     map[uint32]uint32
+	freeLargeObjects map[uint32][]uint32
+	pagePadding      map[uint32]uint32
+	guards           map[uint32]uint32
+	leaks            map[uint32]LeakRecord
+	metadata         map[uint32]blockMetadata
+	freeBlocks       [][]uint32
+	// the header of every block below the bumper, by header offset
+	headers map[uint32][8]byte
+}
+
+// Snapshot captures the allocator state so it can be rolled back with Restore, e.g. after
+// speculatively executing a block. Besides the bookkeeping it saves the 8 byte header of every
+// bumped block, since allocating or freeing a block rewrites its header (and the free list links
+// stored there), or the side metadata in side metadata mode. Payloads aren't saved.
+func (fbha *FreeingBumpHeapAllocator) Snapshot() AllocatorSnapshot {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	snapshot := AllocatorSnapshot{
+		bumper:           fbha.bumper,
+		heads:            append([]uint32(nil), fbha.heads...),
+		totalSize:        fbha.TotalSize,
+		largeObjects:     make(map[uint32]uint32, len(fbha.largeObjects)),
+		freeLargeObjects: make(map[uint32][]uint32, len(fbha.freeLargeObjects)),
+		pagePadding:      make(map[uint32]uint32, len(fbha.pagePadding)),
+		guards:           make(map[uint32]uint32, len(fbha.guards)),
+		leaks:            make(map[uint32]LeakRecord, len(fbha.leaks)),
+		metadata:         make(map[uint32]blockMetadata, len(fbha.metadata)),
+		freeBlocks:       make([][]uint32, len(fbha.freeBlocks)),
+		headers:          make(map[uint32][8]byte),
+	}
+	for ptr, size := range fbha.largeObjects {
+		snapshot.largeObjects[ptr] = size
+	}
+	for size, free := range fbha.freeLargeObjects {
+		snapshot.freeLargeObjects[size] = append([]uint32(nil), free...)
+	}
+	for ptr, padding := range fbha.pagePadding {
+		snapshot.pagePadding[ptr] = padding
+	}
+	for ptr, size := range fbha.guards {
+		snapshot.guards[ptr] = size
+	}
+	for ptr, record := range fbha.leaks {
+		snapshot.leaks[ptr] = record
+	}
+	for ptr, meta := range fbha.metadata {
+		snapshot.metadata[ptr] = meta
+	}
+	for i, free := range fbha.freeBlocks {
+		snapshot.freeBlocks[i] = append([]uint32(nil), free...)
+	}
+	if fbha.sideMetadata {
+		return snapshot
+	}
+
+	// blocks are bumped back to back, so the heap can be walked by block size
+	data := fbha.heap.Data()
+	for block := uint32(0); block < fbha.bumper; {
+		size, ok := fbha.blockSize(block)
+		if !ok {
+			break
+		}
+		// only the last 8 bytes of a header padded to the alignment are used
+		headerOffset := block + fbha.blockPadding(block) + fbha.alignment - 8
+		var header [8]byte
+		copy(header[:], data[fbha.ptrOffset+headerOffset:])
+		snapshot.headers[headerOffset] = header
+		block += size
+	}
+
+	return snapshot
+}
+
+// Restore puts back the allocator state captured by Snapshot, discarding everything allocated
+// or freed since. Payloads written in the meantime are left as they are.
+func (fbha *FreeingBumpHeapAllocator) Restore(snapshot AllocatorSnapshot) {
+	fbha.lock.Lock()
+	defer func() {
+		notify := fbha.checkPressure()
+		fbha.lock.Unlock()
+		notify()
+	}()
+
+	fbha.bumper = snapshot.bumper
+	fbha.heads = append([]uint32(nil), snapshot.heads...)
+	fbha.TotalSize = snapshot.totalSize
+	fbha.largeObjects = make(map[uint32]uint32, len(snapshot.largeObjects))
+	for ptr, size := range snapshot.largeObjects {
+		fbha.largeObjects[ptr] = size
+	}
+	fbha.freeLargeObjects = make(map[uint32][]uint32, len(snapshot.freeLargeObjects))
+	for size, free := range snapshot.freeLargeObjects {
+		fbha.freeLargeObjects[size] = append([]uint32(nil), free...)
+	}
+	fbha.pagePadding = make(map[uint32]uint32, len(snapshot.pagePadding))
+	for ptr, padding := range snapshot.pagePadding {
+		fbha.pagePadding[ptr] = padding
+	}
+	// the guard bytes are in the payload, which isn't saved, but they always hold the guard marker
+	fbha.guards = make(map[uint32]uint32, len(snapshot.guards))
+	for ptr, size := range snapshot.guards {
+		fbha.setGuard(ptr, size)
+	}
+	fbha.leaks = make(map[uint32]LeakRecord, len(snapshot.leaks))
+	for ptr, record := range snapshot.leaks {
+		fbha.leaks[ptr] = record
+	}
+	fbha.metadata = make(map[uint32]blockMetadata, len(snapshot.metadata))
+	for ptr, meta := range snapshot.metadata {
+		fbha.metadata[ptr] = meta
+	}
+	for i, free := range snapshot.freeBlocks {
+		fbha.freeBlocks[i] = append([]uint32(nil), free...)
+	}
+
+	data := fbha.heap.Data()
+	for headerOffset, header := range snapshot.headers {
+		copy(data[fbha.ptrOffset+headerOffset:], header[:])
+	}
+}
+
+// blockSize returns the size, header and page padding included, of the bumped block at offset block
+func (fbha *FreeingBumpHeapAllocator) blockSize(block uint32) (uint32, bool) {
+	padding := fbha.blockPadding(block)
+	ptr := block + padding + fbha.headerSize()
+	if size, ok := fbha.largeObjects[ptr]; ok {
+		return padding + size + fbha.headerSize(), true
+	}
+	if size, ok := fbha.freedLargeSize(ptr); ok {
+		return padding + size + fbha.headerSize(), true
+	}
+	if fbha.sideMetadata {
+		meta, ok := fbha.metadata[ptr]
+		if !ok {
+			return 0, false
+		}
+		return uint32(getItemSizeFromIndex(uint(meta.listIndex))), true
+	}
+
+	var listIndex uint8
+	switch {
+	case fbha.isLive(ptr):
+		listIndex = fbha.getHeapByte(ptr - 8)
+	case fbha.isFreed(ptr):
+		listIndex = fbha.getHeapByte(ptr - 4)
+	default:
+		return 0, false
+	}
+	if int(listIndex) >= len(fbha.heads) {
+		return 0, false
+	}
+	return uint32(getItemSizeFromIndex(uint(listIndex))) + fbha.alignment, true
+}
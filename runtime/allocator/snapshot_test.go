@@ -0,0 +1,153 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+// test that Restore rolls back allocations and frees made after Snapshot
+func TestShouldRestoreSnapshot(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := fbha.Allocate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(freed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := fbha.Snapshot()
+	expected := allocatorState{
+		bumper:    fbha.bumper,
+		heads:     nonEmptyHeads(fbha.heads),
+		totalSize: fbha.TotalSize,
+	}
+
+	// the first allocation after the snapshot reuses the freed block
+	first, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != freed {
+		t.Fatalf("Fail: got %d expected %d", first, freed)
+	}
+	_, err = fbha.Allocate(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbha.Restore(snapshot)
+
+	compareState(fbha, expected, nil, nil, t)
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot copied the heads, so it is unaffected by later allocations
+	ptr, err := fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr != first {
+		t.Errorf("Fail: got %d expected %d", ptr, first)
+	}
+	if heads := nonEmptyHeads(snapshot.heads); !reflect.DeepEqual(heads, expected.heads) {
+		t.Errorf("Fail: got snapshot heads %v expected %v", heads, expected.heads)
+	}
+
+	// the block freed after the snapshot is live again
+	err = fbha.Deallocate(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that Snapshot walks blocks with headers padded to a larger alignment
+func TestShouldRestoreSnapshotWithAlignment(t *testing.T) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocatorWithConfig(mem, 0, AllocatorConfig{Alignment: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ptrs []uint32
+	for _, size := range []uint32{1, 42, 42, 100} {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	err = fbha.Deallocate(ptrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := fbha.Snapshot()
+	if len(snapshot.headers) != len(ptrs) {
+		t.Fatalf("Fail: got %d headers expected %d", len(snapshot.headers), len(ptrs))
+	}
+	expected := allocatorState{
+		bumper:    fbha.bumper,
+		heads:     nonEmptyHeads(fbha.heads),
+		totalSize: fbha.TotalSize,
+	}
+
+	_, err = fbha.Allocate(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fbha.Deallocate(ptrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbha.Restore(snapshot)
+
+	compareState(fbha, expected, nil, nil, t)
+	err = fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// ErrHeaderChecksumMismatch is returned by CheckHeaderChecksum when the live block headers changed
+var ErrHeaderChecksumMismatch = errors.New("allocator header checksum mismatch")
+
+// Verify checks the allocator's internal invariants and returns a descriptive error for the
+// first violation found. It is meant for debugging heap corruption and walks every free list,
+// so it shouldn't be called on a hot path.
+//
+// For every free list it checks that each block lies below the bumper, is visited only once,
+// carries the freed marker and stores the list index of the list it is on. It then checks that
+// the live allocations (TotalSize) and the free blocks add up to everything that was bumped.
+func (fbha *FreeingBumpHeapAllocator) Verify() error {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	if fbha.sideMetadata {
+		freeSize, err := fbha.sideFreeSize()
+		if err != nil {
+			return err
+		}
+		return fbha.verifySize(freeSize)
+	}
+
+	var freeSize uint32
+	visited := make(map[uint32]bool)
+	for i, item := range fbha.heads {
+		for item != freeListEnd {
+			if item+8 > fbha.bumper {
+				return fmt.Errorf("free list %d: block %d is past the bumper %d", i, item, fbha.bumper)
+			}
+			if visited[item] {
+				return fmt.Errorf("free list %d: block %d is linked twice", i, item)
+			}
+			visited[item] = true
+
+			ptr := item + 8
+			if !fbha.isFreed(ptr) {
+				return fmt.Errorf("free list %d: block %d has no freed marker", i, item)
+			}
+			if listIndex := fbha.getHeapByte(ptr - 4); int(listIndex) != i {
+				return fmt.Errorf("free list %d: block %d has list index %d", i, item, listIndex)
+			}
+
+			freeSize += uint32(getItemSizeFromIndex(uint(i))) + fbha.alignment
+			item = binary.LittleEndian.Uint32(fbha.getHeap4bytes(item))
+		}
+	}
+
+	return fbha.verifySize(freeSize)
+}
+
+// verifySize checks that the live allocations, the free small blocks and the free large regions add up to the bumper
+func (fbha *FreeingBumpHeapAllocator) verifySize(freeSize uint32) error {
+	for size, free := range fbha.freeLargeObjects {
+		freeSize += (size + fbha.headerSize()) * uint32(len(free))
+		for _, ptr := range free {
+			freeSize += fbha.pagePadding[ptr]
+		}
+	}
+
+	if fbha.TotalSize+freeSize != fbha.bumper {
+		return fmt.Errorf("live size %d plus free size %d doesn't match the bumper %d", fbha.TotalSize, freeSize, fbha.bumper)
+	}
+
+	return nil
+}
+
+// HeaderChecksum returns an FNV-1a hash over the offset and the 8 byte header of every live block,
+// found by walking the bumped blocks like Snapshot. Comparing the checksums taken before and after
+// running external code detects whether it wrote into the allocator's headers. In side metadata
+// mode the headers aren't in the heap, so only the offsets of the live blocks are hashed.
+func (fbha *FreeingBumpHeapAllocator) HeaderChecksum() uint64 {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	return fbha.headerChecksum()
+}
+
+// CheckHeaderChecksum returns ErrHeaderChecksumMismatch if the current HeaderChecksum differs from expected
+func (fbha *FreeingBumpHeapAllocator) CheckHeaderChecksum(expected uint64) error {
+	fbha.lock.Lock()
+	defer fbha.lock.Unlock()
+
+	if sum := fbha.headerChecksum(); sum != expected {
+		return fmt.Errorf("got %x expected %x: %w", sum, expected, ErrHeaderChecksumMismatch)
+	}
+	return nil
+}
+
+func (fbha *FreeingBumpHeapAllocator) headerChecksum() uint64 {
+	hash := fnv.New64a()
+	data := fbha.heap.Data()
+	offset := make([]byte, 4)
+
+	for block := uint32(0); block < fbha.bumper; {
+		size, ok := fbha.blockSize(block)
+		if !ok {
+			if !fbha.sideMetadata {
+				// an unreadable header was tampered with, hash it so the walk stopping changes the checksum
+				headerOffset := fbha.ptrOffset + block + fbha.alignment - 8
+				hash.Write(data[headerOffset : headerOffset+8])
+			}
+			break
+		}
+
+		ptr := block + fbha.blockPadding(block) + fbha.headerSize()
+		_, large := fbha.largeObjects[ptr]
+		if large || fbha.isLive(ptr) {
+			binary.LittleEndian.PutUint32(offset, block)
+			hash.Write(offset)
+			if !fbha.sideMetadata {
+				hash.Write(data[fbha.ptrOffset+ptr-8 : fbha.ptrOffset+ptr])
+			}
+		}
+		block += size
+	}
+
+	return hash.Sum64()
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 ChainSafe Systems (ON) Corp.
+// This file is part of gossamer.
+//
+// The gossamer library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The gossamer library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the gossamer library. If not, see <http://www.gnu.org/licenses/>.
+
+package runtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// utility function that allocates a mix of sizes and frees every other block, returning the
+//  allocator and the freed pointers
+func newFragmentedAllocator(t *testing.T) (*FreeingBumpHeapAllocator, []uint32) {
+	mem, err := NewWasmMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbha, err := NewAllocator(mem, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ptrs []uint32
+	for _, size := range []uint32{1, 8, 9, 42, 8, 100, 9, 1000} {
+		ptr, err := fbha.Allocate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+
+	var freed []uint32
+	for i := 0; i < len(ptrs); i += 2 {
+		err = fbha.Deallocate(ptrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		freed = append(freed, ptrs[i])
+	}
+
+	return fbha, freed
+}
+
+// test that Verify accepts a heap built only through Allocate and Deallocate
+func TestVerifyShouldAcceptConsistentHeap(t *testing.T) {
+	fbha, _ := newFragmentedAllocator(t)
+
+	err := fbha.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test that Verify flags a freed block whose list index byte was overwritten
+func TestVerifyShouldDetectCorruptedHeader(t *testing.T) {
+	fbha, freed := newFragmentedAllocator(t)
+
+	// the second freed block (9 bytes) is on free list 1
+	fbha.heap.Data()[freed[1]-4] = 3
+
+	err := fbha.Verify()
+	if err == nil {
+		t.Fatal("Fail: expected corrupted header to be detected")
+	}
+	t.Log(err)
+}
+
+// test that Verify flags free list links that loop or point past the bumper
+func TestVerifyShouldDetectCorruptedLink(t *testing.T) {
+	fbha, freed := newFragmentedAllocator(t)
+	block := freed[1] - 8
+
+	binary.LittleEndian.PutUint32(fbha.heap.Data()[block:], block)
+	err := fbha.Verify()
+	if err == nil {
+		t.Fatal("Fail: expected free list cycle to be detected")
+	}
+	t.Log(err)
+
+	binary.LittleEndian.PutUint32(fbha.heap.Data()[block:], fbha.bumper+64)
+	err = fbha.Verify()
+	if err == nil {
+		t.Fatal("Fail: expected link past the bumper to be detected")
+	}
+	t.Log(err)
+}
+
+// test that Verify flags accounting that doesn't match the bumper
+func TestVerifyShouldDetectAccountingMismatch(t *testing.T) {
+	fbha, _ := newFragmentedAllocator(t)
+	fbha.TotalSize += 8
+
+	err := fbha.Verify()
+	if err == nil {
+		t.Fatal("Fail: expected accounting mismatch to be detected")
+	}
+	t.Log(err)
+}
+
+// test that writing into a live header changes the header checksum
+func TestShouldDetectHeaderTampering(t *testing.T) {
+	fbha, freed := newFragmentedAllocator(t)
+
+	sum := fbha.HeaderChecksum()
+	if sum != fbha.HeaderChecksum() {
+		t.Fatal("Fail: checksum is not stable")
+	}
+	err := fbha.CheckHeaderChecksum(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writing a payload doesn't change the checksum
+	live := freed[0] + 16
+	fbha.heap.Data()[live] = 42
+	err = fbha.CheckHeaderChecksum(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the block after the first freed one is live, overwrite its list index
+	fbha.heap.Data()[live-8] = 3
+	err = fbha.CheckHeaderChecksum(sum)
+	if !errors.Is(err, ErrHeaderChecksumMismatch) {
+		t.Fatalf("Fail: got %v expected %v", err, ErrHeaderChecksumMismatch)
+	}
+
+	// a legitimate allocation changes the checksum too
+	fbha2, _ := newFragmentedAllocator(t)
+	before := fbha2.HeaderChecksum()
+	_, err = fbha2.Allocate(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fbha2.HeaderChecksum() == before {
+		t.Errorf("Fail: expected checksum to change after an allocation")
+	}
+}
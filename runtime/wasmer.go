@@ -68,7 +68,10 @@ func NewRuntime(code []byte, t *trie.Trie) (*Runtime, error) {
 		return nil, err
 	}
 
-	memAllocator := allocator.NewAllocator(&instance.Memory, 0)
+	memAllocator, err := allocator.NewAllocator(&instance.Memory, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	runtimeCtx := &RuntimeCtx{
 		trie:      t,